@@ -0,0 +1,182 @@
+package chclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	chshare "github.com/yunfeiyang1916/cloud-chisel/share"
+	"github.com/yunfeiyang1916/cloud-chisel/share/cnet"
+	"github.com/yunfeiyang1916/cloud-chisel/share/settings"
+	"golang.org/x/crypto/ssh"
+)
+
+// Hop 多跳连接中位于 Server 之前的一个中间 chisel server。
+// 客户端经由该服务端的通道连接下一跳，因此该跳的用户需要有访问下一跳地址的权限
+type Hop struct {
+	// chisel server url
+	Server string
+	// 可选的用户名和密码，形式为 <user>:<pass>
+	Auth string
+	// 可选的服务端指纹，为空时不检查
+	Fingerprint string
+	// 可选的websocket握手请求头
+	Headers http.Header
+	// 可选的websocket端点路径，为空时使用 Config.WebSocketPath
+	WebSocketPath string
+}
+
+// 解析后的中间服务端
+type hop struct {
+	url       string
+	headers   http.Header
+	sshConfig *ssh.ClientConfig
+}
+
+// 按配置创建中间服务端列表
+func (c *Client) newChain(hops []Hop) ([]hop, error) {
+	chain := make([]hop, len(hops))
+	for i, h := range hops {
+		wsPath := h.WebSocketPath
+		if wsPath == "" {
+			wsPath = c.config.WebSocketPath
+		}
+		u, err := serverURL(h.Server, wsPath)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid hop '%s': %s", h.Server, err)
+		}
+		user, pass := settings.ParseAuth(h.Auth)
+		expect := h.Fingerprint
+		chain[i] = hop{
+			url:     u.String(),
+			headers: h.Headers,
+			sshConfig: &ssh.ClientConfig{
+				User:          user,
+				Auth:          []ssh.AuthMethod{ssh.Password(pass)},
+				ClientVersion: "SSH-" + chshare.ProtocolVersion + "-client",
+				HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+					return c.checkFingerprint(key, expect)
+				},
+				Timeout: c.sshConfig.Timeout,
+			},
+		}
+	}
+	return chain, nil
+}
+
+// dialChain 逐跳连接 Chain 中的服务端，返回经由最后一跳的通道到 addr 的连接。
+// 关闭返回的连接时同时关闭各跳的SSH连接
+func (c *Client) dialChain(ctx context.Context, addr string) (net.Conn, error) {
+	cc := &chainConn{}
+	var prev net.Conn
+	for i, h := range c.chain {
+		next := addr
+		if i+1 < len(c.chain) {
+			u, _ := url.Parse(c.chain[i+1].url)
+			next = u.Host
+		}
+		conn, sshConn, err := c.dialHop(ctx, h, prev, next)
+		if err != nil {
+			cc.closeHops()
+			return nil, fmt.Errorf("hop %s: %w", h.url, err)
+		}
+		cc.hops = append(cc.hops, sshConn)
+		prev = conn
+	}
+	cc.Conn = prev
+	return cc, nil
+}
+
+// 连接一个中间服务端并打开到 next 的通道。prev 为经由上一跳的连接，nil表示直接连接
+func (c *Client) dialHop(ctx context.Context, h hop, prev net.Conn, next string) (net.Conn, ssh.Conn, error) {
+	d, err := c.wsDialer()
+	if err != nil {
+		return nil, nil, err
+	}
+	if prev != nil {
+		d.Proxy, d.NetDial = nil, nil
+		d.NetDialContext = func(context.Context, string, string) (net.Conn, error) {
+			return prev, nil
+		}
+	}
+	headers := h.headers.Clone()
+	if p := c.config.ProtocolHeader; p != "" {
+		if headers == nil {
+			headers = http.Header{}
+		}
+		headers.Set(p, chshare.ProtocolVersion)
+	}
+	c.Debugf("Connecting to hop %s", h.url)
+	wsConn, resp, err := d.DialContext(ctx, h.url, headers)
+	if err != nil {
+		if busy := busyError(resp); busy != nil {
+			return nil, nil, busy
+		}
+		return nil, nil, err
+	}
+	conn := cnet.NewWebSocketConn(wsConn)
+	if d := c.config.WebSocketPing; d > 0 {
+		cnet.PingWebSocket(conn, d, c.config.KeepAliveMaxMissed)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, "", h.sshConfig)
+	if err != nil {
+		conn.Close()
+		if e := err.Error(); strings.Contains(e, "unable to authenticate") {
+			return nil, nil, &AuthError{Message: e}
+		}
+		return nil, nil, err
+	}
+	// 中间服务端不需要任何远程映射，只用于打开到下一跳的通道
+	config := settings.Config{
+		Version:      chshare.BuildVersion,
+		Labels:       c.config.Labels,
+		Capabilities: settings.Capabilities{settings.CapConfigReply, settings.CapRejectCodes},
+	}
+	ok, reply, err := sshConn.SendRequest("config", true, settings.EncodeConfig(config))
+	if err == nil && !ok {
+		_, err = replyError(reply)
+	}
+	if err != nil {
+		sshConn.Close()
+		return nil, nil, err
+	}
+	// 回复服务端的保活ping，拒绝服务端打开的通道
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		for ch := range chans {
+			ch.Reject(ssh.Prohibited, "hop does not accept channels")
+		}
+	}()
+	ch, chReqs, err := sshConn.OpenChannel("chisel", []byte(next))
+	if err != nil {
+		sshConn.Close()
+		return nil, nil, err
+	}
+	go ssh.DiscardRequests(chReqs)
+	c.Debugf("Hop %s connected to %s", h.url, next)
+	return cnet.NewRWCConn(ch), sshConn, nil
+}
+
+// chainConn 经由多跳通道的连接，关闭时同时关闭各跳的SSH连接
+type chainConn struct {
+	net.Conn
+	hops []ssh.Conn
+	once sync.Once
+}
+
+func (c *chainConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.closeHops)
+	return err
+}
+
+// 从最后一跳开始关闭各跳的SSH连接
+func (c *chainConn) closeHops() {
+	for i := len(c.hops) - 1; i >= 0; i-- {
+		c.hops[i].Close()
+	}
+}
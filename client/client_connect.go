@@ -9,23 +9,52 @@ import (
 	chshare "github.com/yunfeiyang1916/cloud-chisel/share"
 	"github.com/yunfeiyang1916/cloud-chisel/share/cnet"
 	"github.com/yunfeiyang1916/cloud-chisel/share/cos"
+	"github.com/yunfeiyang1916/cloud-chisel/share/events"
 	"github.com/yunfeiyang1916/cloud-chisel/share/settings"
 	"golang.org/x/crypto/ssh"
 	"io"
 	"net"
+	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
 
 // 轮询连接
 func (c *Client) connectionLoop(ctx context.Context) error {
-	b := &backoff.Backoff{Max: c.config.MaxRetryInterval}
+	b := c.newBackoff()
+	var lastErr error
+	// 连续认证失败的次数
+	authFailures := 0
+	// 连续不可重试的服务端数量
+	rejected := 0
 	for {
+		c.state.setServer(c.servers.active().url)
+		c.state.set(StateConnecting, lastErr, 0)
 		connected, retry, err := c.connectionOnce(ctx)
 		// 连接成功后复位backoff,也就是将attempt(尝试计数器)置为0
 		if connected {
 			b.Reset()
 		}
+		// 当前服务端不可重试时立即切换到下一个服务端，所有服务端都不可重试时才放弃
+		if !retry && !connected && ctx.Err() == nil && c.servers.size() > 1 && !isAuthRetry(err, c.config.CircuitBreakerThreshold) {
+			rejected++
+			if rejected < c.servers.size() {
+				if err != nil {
+					lastErr = err
+					c.Infof("Connection error: %s", err)
+				}
+				c.servers.skip()
+				c.Infof("Switching to %s", c.servers.active().url)
+				continue
+			}
+		} else {
+			rejected = 0
+		}
+		// 按策略切换服务端
+		if (connected && c.servers.succeeded()) || (!connected && c.servers.failed()) {
+			c.Infof("Switching to %s", c.servers.active().url)
+		}
 		// connection error
 		// 尝试计数器
 		attempt := int(b.Attempt())
@@ -36,7 +65,9 @@ func (c *Client) connectionLoop(ctx context.Context) error {
 			err = io.EOF
 		}
 		// 显示错误消息和尝试计数(不包括断开连接)
+		lastErr = nil
 		if err != nil && err != io.EOF {
+			lastErr = err
 			msg := fmt.Sprintf("Connection error: %s", err)
 			if attempt > 0 {
 				msg += fmt.Sprintf(" (Attempt: %d", attempt)
@@ -47,24 +78,51 @@ func (c *Client) connectionLoop(ctx context.Context) error {
 			}
 			c.Infof(msg)
 		}
+		// 熔断：认证失败时不放弃重试，连续失败达到阈值后暂停更长时间
+		var authErr *AuthError
+		if errors.As(err, &authErr) {
+			authFailures++
+			if c.config.CircuitBreakerThreshold > 0 {
+				retry = true
+			}
+		} else {
+			authFailures = 0
+		}
+		// 通过 Reconnect 主动断开时立即重连
+		select {
+		case <-c.reconnect:
+			continue
+		default:
+		}
 		// 已放弃重试
 		if !retry || (maxAttempt >= 0 && attempt >= maxAttempt) {
 			c.Infof("Give up")
 			break
 		}
-		// 返回在尝试计数器递增之前的当前尝试的持续时间,尝试计数器已经递增
-		d := b.Duration()
+		c.state.set(StateDisconnected, lastErr, 0)
+		d := c.retryDelay(b, err, authFailures)
 		c.Infof("Retrying in %s...", d)
 		select {
 		case <-cos.AfterSignal(d):
 			continue //retry now
+		case <-c.reconnect:
+			continue
 		case <-ctx.Done():
 			c.Infof("Cancelled")
+			c.state.set(StateGaveUp, lastErr, 0)
 			return nil
 		}
 	}
+	c.state.set(StateGaveUp, lastErr, 0)
 	c.Close()
-	return nil
+	// 放弃重试时返回最后一次的错误，以便调用者通过 errors.As 判断 AuthError 等错误类型
+	return lastErr
+}
+
+// 认证失败且开启了熔断时由熔断处理重试，不切换服务端
+func isAuthRetry(err error, threshold int) bool {
+	var authErr *AuthError
+	return threshold > 0 && errors.As(err, &authErr)
 }
 
 // 连接 chisel server 并阻塞
@@ -78,26 +136,10 @@ func (c *Client) connectionOnce(ctx context.Context) (connected, retry bool, err
 	}
 	ctx, cancle := context.WithCancel(ctx)
 	defer cancle()
-	// 准备拨号器
-	d := websocket.Dialer{
-		// 握手超时时间，默认45秒
-		HandshakeTimeout: settings.EnvDuration("WS_TIMEOUT", 45*time.Second),
-		Subprotocols:     []string{chshare.ProtocolVersion},
-		TLSClientConfig:  c.tlsConfig,
-		ReadBufferSize:   settings.EnvInt("WS_BUFF_SIZE", 0),
-		WriteBufferSize:  settings.EnvInt("WS_BUFF_SIZE", 0),
-	}
-	// 设置代理
-	if p := c.proxyURL; p != nil {
-		if err := c.setProxy(p, &d); err != nil {
-			return false, false, err
-		}
-	}
-	wsConn, _, err := d.DialContext(ctx, c.server, c.config.Headers)
+	conn, retry, err := c.dialServer(ctx)
 	if err != nil {
-		return false, true, err
+		return false, retry, err
 	}
-	conn := cnet.NewWebSocketConn(wsConn)
 	// 执行ssh握手
 	c.Debugf("Handshaking...")
 	sshConn, chans, reqs, err := ssh.NewClientConn(conn, "", c.sshConfig)
@@ -107,6 +149,10 @@ func (c *Client) connectionOnce(ctx context.Context) (connected, retry bool, err
 		if strings.Contains(e, "unable to authenticate") {
 			c.Infof("Authentication failed")
 			c.Debugf(e)
+			err = &AuthError{Message: e}
+			ev := c.event(events.AuthFailed)
+			ev.Err = err
+			c.emit(ev)
 			retry = false
 		} else if strings.Contains(e, "connection abort") {
 			c.Infof("retriable: %s", e)
@@ -122,22 +168,13 @@ func (c *Client) connectionOnce(ctx context.Context) (connected, retry bool, err
 	}
 	defer sshConn.Close()
 	// chisel client handshake (reverse of server handshake) send configuration
-	c.Debugf("Sending config")
 	t0 := time.Now()
-	_, configerr, err := sshConn.SendRequest(
-		"config",
-		true,
-		settings.EncodeConfig(c.computed),
-	)
+	latency, retry, err := c.handshake(sshConn)
 	if err != nil {
-		c.Infof("Config verification failed")
-		return false, false, err
-	}
-	if len(configerr) > 0 {
-		return false, false, errors.New(string(configerr))
+		return false, retry, err
 	}
-	// 连接延迟时长
-	c.Infof("Connected (Latency %s)", time.Since(t0))
+	c.emit(c.event(events.SessionStarted))
+	c.state.set(StateConnected, nil, latency)
 	// 移交SSH连接以便隧道使用，并阻塞
 	retry = true
 	err = c.tunnel.BindSSH(ctx, sshConn, reqs, chans)
@@ -146,6 +183,151 @@ func (c *Client) connectionOnce(ctx context.Context) (connected, retry bool, err
 	}
 	// 已分离连接
 	c.Infof("Disconnected")
+	var sessErr error
+	if err != nil && !strings.HasSuffix(err.Error(), "EOF") {
+		sessErr = err
+	}
+	e := c.event(events.SessionEnded)
+	e.Err = sessErr
+	c.emit(e)
+	c.setSession(nil)
 	connected = time.Since(t0) > 5*time.Second
 	return connected, retry, err
 }
+
+// handshake 发送配置并等待服务端验证，验证通过后设置当前会话。
+// 握手期间不允许增删远程映射，以免新的映射既不在配置中也没有发送给服务端
+func (c *Client) handshake(sshConn ssh.Conn) (latency time.Duration, retry bool, err error) {
+	c.updateMut.Lock()
+	defer c.updateMut.Unlock()
+	c.Debugf("Sending config")
+	t0 := time.Now()
+	ok, reply, err := sshConn.SendRequest(
+		"config",
+		true,
+		settings.EncodeConfig(c.currentConfig()),
+	)
+	if err != nil {
+		c.Infof("Config verification failed")
+		return 0, false, err
+	}
+	if !ok {
+		retry, err := replyError(reply)
+		return 0, retry, err
+	}
+	// 旧版本服务端回复空内容，不支持任何能力
+	var caps settings.Capabilities
+	if len(reply) > 0 {
+		r, err := settings.DecodeConfigReply(reply)
+		if err != nil {
+			return 0, false, err
+		}
+		caps = r.Capabilities
+	}
+	// 连接延迟时长
+	latency = time.Since(t0)
+	c.Infof("Connected (Latency %s)", latency)
+	c.setSession(&session{
+		id:         strconv.Itoa(int(c.connCount.New())),
+		localAddr:  sshConn.LocalAddr().String(),
+		remoteAddr: sshConn.RemoteAddr().String(),
+		caps:       caps,
+		conn:       sshConn,
+	})
+	return latency, false, nil
+}
+
+// dialServer 建立到当前服务端的websocket连接，配置了 Chain 时经由各跳服务端连接
+func (c *Client) dialServer(ctx context.Context) (conn net.Conn, retry bool, err error) {
+	d, err := c.wsDialer()
+	if err != nil {
+		return nil, false, err
+	}
+	if len(c.chain) > 0 {
+		d.Proxy, d.NetDial = nil, nil
+		d.NetDialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return c.dialChain(ctx, addr)
+		}
+	}
+	wsConn, resp, err := d.DialContext(ctx, c.servers.active().url, c.wsHeaders())
+	if err != nil {
+		if busy := busyError(resp); busy != nil {
+			return nil, true, busy
+		}
+		// 中间服务端认证失败，与连接服务端时相同不再重试
+		var authErr *AuthError
+		if errors.As(err, &authErr) {
+			return nil, false, err
+		}
+		return nil, true, err
+	}
+	conn = cnet.NewWebSocketConn(wsConn)
+	if d := c.config.WebSocketPing; d > 0 {
+		cnet.PingWebSocket(conn, d, c.config.KeepAliveMaxMissed)
+	}
+	return conn, false, nil
+}
+
+// 创建websocket拨号器，按配置使用代理或 Config.DialContext
+func (c *Client) wsDialer() (*websocket.Dialer, error) {
+	d := &websocket.Dialer{
+		// 握手超时时间，默认45秒
+		HandshakeTimeout: settings.EnvDuration("WS_TIMEOUT", 45*time.Second),
+		Subprotocols:     []string{chshare.ProtocolVersion},
+		TLSClientConfig:  c.tlsConfig,
+		ReadBufferSize:   settings.EnvInt("WS_BUFF_SIZE", 0),
+		WriteBufferSize:  settings.EnvInt("WS_BUFF_SIZE", 0),
+	}
+	// 设置代理
+	if p := c.proxyURL; p != nil {
+		if err := c.setProxy(p, d); err != nil {
+			return nil, err
+		}
+	}
+	if c.config.DialContext != nil && d.NetDial == nil {
+		d.NetDialContext = c.config.DialContext
+	}
+	return d, nil
+}
+
+// websocket握手的请求头
+func (c *Client) wsHeaders() http.Header {
+	headers := c.config.Headers
+	if h := c.config.ProtocolHeader; h != "" {
+		headers = headers.Clone()
+		if headers == nil {
+			headers = http.Header{}
+		}
+		headers.Set(h, chshare.ProtocolVersion)
+	}
+	return headers
+}
+
+// 按配置创建重连的退避策略
+// retryDelay 返回重试前的等待时长：backoff的时长，服务端建议的等待时长更长时使用建议值，
+// 但不超过 MaxRetryInterval；连续认证失败达到熔断阈值时暂停 CircuitBreakerPause
+func (c *Client) retryDelay(b *backoff.Backoff, err error, authFailures int) time.Duration {
+	// 返回在尝试计数器递增之前的当前尝试的持续时间,尝试计数器已经递增
+	d := b.Duration()
+	// 服务端建议的等待时长
+	if hint := retryAfter(err); hint > d {
+		d = hint
+		if max := c.config.MaxRetryInterval; d > max {
+			d = max
+		}
+	}
+	if t := c.config.CircuitBreakerThreshold; t > 0 && authFailures >= t {
+		c.Infof("Circuit breaker open after %d authentication failures", authFailures)
+		d = c.config.CircuitBreakerPause
+	}
+	return d
+}
+
+func (c *Client) newBackoff() *backoff.Backoff {
+	return &backoff.Backoff{
+		Min:    c.config.MinRetryInterval,
+		Max:    c.config.MaxRetryInterval,
+		Factor: c.config.RetryFactor,
+		Jitter: c.config.RetryJitter,
+	}
+}
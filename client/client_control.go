@@ -0,0 +1,403 @@
+package chclient
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yunfeiyang1916/cloud-chisel/share/tunnel"
+)
+
+// ControlStatus 控制API返回的客户端状态
+type ControlStatus struct {
+	State       string        `json:"state"`
+	Since       time.Time     `json:"since"`
+	Error       string        `json:"error,omitempty"`
+	Latency     time.Duration `json:"latency"`
+	Jitter      time.Duration `json:"jitter"`
+	MissedPings int64         `json:"missed_pings"`
+	Server      string        `json:"server"`
+	// 连接池中已连接和配置的辅助连接数量
+	PoolConnected int           `json:"pool_connected,omitempty"`
+	PoolSize      int           `json:"pool_size,omitempty"`
+	Fingerprint   string        `json:"fingerprint,omitempty"`
+	Remotes       []RemoteStats `json:"remotes"`
+	Connections   []ConnInfo    `json:"connections"`
+}
+
+// RemoteStats 远程映射的连接统计，字节数在连接关闭时累计
+type RemoteStats struct {
+	Remote   string `json:"remote"`
+	Open     int    `json:"open"`
+	Total    int64  `json:"total"`
+	Sent     int64  `json:"sent"`
+	Received int64  `json:"received"`
+	// 隧道断开时到达的连接按处理结果计数，比如 held、rejected、timeout
+	Down map[string]int64 `json:"down,omitempty"`
+}
+
+// ConnInfo 打开中的转发连接
+type ConnInfo struct {
+	Remote string    `json:"remote,omitempty"`
+	Source string    `json:"source"`
+	Target string    `json:"target"`
+	Proto  string    `json:"proto"`
+	Start  time.Time `json:"start"`
+}
+
+// forwardStats 按远程映射统计转发连接
+type forwardStats struct {
+	sync.Mutex
+	remotes map[string]*RemoteStats
+	open    map[*tunnel.ForwardInfo]struct{}
+}
+
+func newForwardStats() *forwardStats {
+	return &forwardStats{
+		remotes: map[string]*RemoteStats{},
+		open:    map[*tunnel.ForwardInfo]struct{}{},
+	}
+}
+
+// 远程映射的统计，不属于任何映射的连接(比如 DialContext)计入空键
+func (fs *forwardStats) get(f *tunnel.ForwardInfo) *RemoteStats {
+	key := ""
+	if f.Remote != nil {
+		key = f.Remote.Encode()
+	}
+	rs, ok := fs.remotes[key]
+	if !ok {
+		rs = &RemoteStats{Remote: key}
+		fs.remotes[key] = rs
+	}
+	return rs
+}
+
+func (fs *forwardStats) opened(f *tunnel.ForwardInfo) {
+	fs.Lock()
+	defer fs.Unlock()
+	rs := fs.get(f)
+	rs.Open++
+	rs.Total++
+	fs.open[f] = struct{}{}
+}
+
+func (fs *forwardStats) closed(f *tunnel.ForwardInfo) {
+	fs.Lock()
+	defer fs.Unlock()
+	rs := fs.get(f)
+	rs.Open--
+	rs.Sent += f.Sent
+	rs.Received += f.Received
+	if f.Down != "" {
+		if rs.Down == nil {
+			rs.Down = map[string]int64{}
+		}
+		rs.Down[f.Down]++
+	}
+	delete(fs.open, f)
+}
+
+// ControlStatus 返回客户端的状态、远程映射的统计和打开中的连接
+func (c *Client) ControlStatus() ControlStatus {
+	st := c.Status()
+	cs := ControlStatus{
+		State:         st.State.String(),
+		Since:         st.Since,
+		Latency:       st.Latency,
+		Jitter:        st.Jitter,
+		MissedPings:   c.tunnel.RTT().Missed,
+		Server:        st.Server,
+		PoolConnected: st.PoolConnected,
+		PoolSize:      st.PoolSize,
+	}
+	if st.Err != nil {
+		cs.Error = st.Err.Error()
+	}
+	c.sessMut.RLock()
+	cs.Fingerprint = c.fingerprint
+	c.sessMut.RUnlock()
+	c.stats.Lock()
+	defer c.stats.Unlock()
+	for _, r := range c.remotes() {
+		rs := RemoteStats{Remote: r.Encode()}
+		if s, ok := c.stats.remotes[rs.Remote]; ok {
+			rs = *s
+			rs.Down = nil
+			for k, v := range s.Down {
+				if rs.Down == nil {
+					rs.Down = map[string]int64{}
+				}
+				rs.Down[k] = v
+			}
+		}
+		cs.Remotes = append(cs.Remotes, rs)
+	}
+	for f := range c.stats.open {
+		ci := ConnInfo{Source: f.Source, Target: f.Target, Proto: f.Proto, Start: f.Start}
+		if f.Remote != nil {
+			ci.Remote = f.Remote.Encode()
+		}
+		cs.Connections = append(cs.Connections, ci)
+	}
+	sort.Slice(cs.Connections, func(i, j int) bool {
+		return cs.Connections[i].Start.Before(cs.Connections[j].Start)
+	})
+	return cs
+}
+
+// Reconnect 断开当前连接并立即重连，跳过重试前的等待
+func (c *Client) Reconnect() {
+	select {
+	case c.reconnect <- struct{}{}:
+	default:
+	}
+	c.sessMut.RLock()
+	sess := c.sess
+	c.sessMut.RUnlock()
+	if sess != nil {
+		c.Infof("Reconnecting")
+		sess.conn.Close()
+	}
+}
+
+// 监听控制API的地址，TCP地址只能是回环地址
+func listenControl(addr string) (net.Listener, error) {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		// 清理上次未正常退出时遗留的socket文件
+		if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(path, 0600); err != nil {
+			l.Close()
+			return nil, err
+		}
+		return l, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("control address must be a loopback address: %s", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// 控制API令牌文件的路径，unix socket 为 <socket路径>.token，
+// TCP地址为临时目录下的 chisel-control-<port>.token，其中 port 为实际监听的端口
+func controlTokenPath(addr string) string {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		return path + ".token"
+	}
+	_, port, _ := net.SplitHostPort(addr)
+	return filepath.Join(os.TempDir(), "chisel-control-"+port+".token")
+}
+
+// 生成本实例的控制API令牌并写入只有当前用户可读的令牌文件
+func writeControlToken(path string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	// 只清理自己遗留的令牌文件，其他用户预先创建的文件会导致创建失败
+	if fi, err := os.Lstat(path); err == nil && fi.Mode().IsRegular() {
+		os.Remove(path)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.WriteString(token); err != nil {
+		f.Close()
+		os.Remove(path)
+		return "", err
+	}
+	return token, f.Close()
+}
+
+// 是否为回环地址的Host请求头，用于防止DNS重绑定
+func loopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+// 校验控制API请求：必须携带本实例的令牌，拒绝浏览器发起的跨域请求(Origin)。
+// TCP监听时还要求回环地址的Host，修改状态的请求必须是 application/json，防止CSRF和DNS重绑定
+func controlGuard(token string, tcp bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Origin") != "" {
+			controlError(w, http.StatusForbidden, errors.New("cross-origin requests are not allowed"))
+			return
+		}
+		if tcp && !loopbackHost(r.Host) {
+			controlError(w, http.StatusForbidden, errors.New("host must be a loopback address"))
+			return
+		}
+		auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+			controlError(w, http.StatusUnauthorized, errors.New("invalid control token"))
+			return
+		}
+		if tcp && r.Method != http.MethodGet {
+			if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/json" {
+				controlError(w, http.StatusUnsupportedMediaType, errors.New("content type must be application/json"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// 提供控制API，直到ctx被取消。令牌写入令牌文件，退出时删除
+func (c *Client) serveControl(ctx context.Context, l net.Listener) error {
+	addr := c.config.ControlAddr
+	_, tcp := l.(*net.TCPListener)
+	if tcp {
+		// 端口为0时由系统分配，令牌文件按实际端口命名，QueryStatus 才能找到
+		addr = l.Addr().String()
+	}
+	path := controlTokenPath(addr)
+	token, err := writeControlToken(path)
+	if err != nil {
+		l.Close()
+		return fmt.Errorf("Control API token: %s", err)
+	}
+	defer os.Remove(path)
+	h := &http.Server{Handler: controlGuard(token, tcp, c.controlHandler())}
+	go func() {
+		<-ctx.Done()
+		h.Close()
+	}()
+	c.Infof("Control API listening on %s (token in %s)", l.Addr(), path)
+	if err := h.Serve(l); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// 控制API的请求处理
+func (c *Client) controlHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			controlError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		controlReply(w, c.ControlStatus())
+	})
+	mux.HandleFunc("/remotes", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Remote string `json:"remote"`
+		}
+		if r.Method == http.MethodGet {
+			controlReply(w, c.ControlStatus().Remotes)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Remote == "" {
+			controlError(w, http.StatusBadRequest, errors.New("expected {\"remote\": \"<remote>\"}"))
+			return
+		}
+		var err error
+		switch r.Method {
+		case http.MethodPost:
+			err = c.AddRemote(body.Remote)
+		case http.MethodDelete:
+			err = c.RemoveRemote(body.Remote)
+		default:
+			controlError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		if err != nil {
+			controlError(w, http.StatusConflict, err)
+			return
+		}
+		controlReply(w, c.ControlStatus().Remotes)
+	})
+	mux.HandleFunc("/reconnect", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			controlError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		c.Reconnect()
+		controlReply(w, c.ControlStatus())
+	})
+	return mux
+}
+
+func controlReply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func controlError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// QueryStatus 通过控制API查询运行中客户端的状态，addr 与 Config.ControlAddr 相同，
+// 令牌从客户端写入的令牌文件读取
+func QueryStatus(ctx context.Context, addr string) (*ControlStatus, error) {
+	token, err := ioutil.ReadFile(controlTokenPath(addr))
+	if err != nil {
+		return nil, fmt.Errorf("control API token: %s", err)
+	}
+	network, address, host := "tcp", addr, addr
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		network, address, host = "unix", path, "unix"
+	}
+	hc := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+	}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+host+"/status", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("control API: %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	cs := &ControlStatus{}
+	if err := json.Unmarshal(b, cs); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
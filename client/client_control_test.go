@@ -0,0 +1,143 @@
+package chclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestControlGuard(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := controlGuard("secret", true, ok)
+	tests := []struct {
+		name   string
+		method string
+		host   string
+		header map[string]string
+		code   int
+	}{
+		{"ok", "GET", "127.0.0.1:9000", map[string]string{"Authorization": "Bearer secret"}, 200},
+		{"ok post", "POST", "localhost:9000", map[string]string{"Authorization": "Bearer secret", "Content-Type": "application/json; charset=utf-8"}, 200},
+		{"ipv6 host", "GET", "[::1]:9000", map[string]string{"Authorization": "Bearer secret"}, 200},
+		{"no token", "GET", "127.0.0.1:9000", nil, 401},
+		{"wrong token", "GET", "127.0.0.1:9000", map[string]string{"Authorization": "Bearer nope"}, 401},
+		{"origin", "GET", "127.0.0.1:9000", map[string]string{"Authorization": "Bearer secret", "Origin": "http://127.0.0.1:9000"}, 403},
+		{"rebound host", "GET", "evil.example.com:9000", map[string]string{"Authorization": "Bearer secret"}, 403},
+		{"form post", "POST", "127.0.0.1:9000", map[string]string{"Authorization": "Bearer secret", "Content-Type": "text/plain"}, 415},
+		{"no content type", "DELETE", "127.0.0.1:9000", map[string]string{"Authorization": "Bearer secret"}, 415},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "http://"+tt.host+"/remotes", strings.NewReader("{}"))
+		r.Host = tt.host
+		for k, v := range tt.header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.code, w.Code)
+		}
+	}
+}
+
+func TestControlUnixNoHostCheck(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := controlGuard("secret", false, ok)
+	r := httptest.NewRequest("POST", "http://unix/reconnect", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+}
+
+func TestQueryStatusToken(t *testing.T) {
+	dir, err := os.MkdirTemp("", "chisel-control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := "unix:" + filepath.Join(dir, "control.sock")
+	c, err := NewClient(&Config{Server: "http://127.0.0.1:1", ControlAddr: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Info = false
+	l, err := listenControl(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.serveControl(ctx, l) }()
+	defer func() {
+		cancel()
+		<-done
+		if _, err := os.Stat(controlTokenPath(addr)); !os.IsNotExist(err) {
+			t.Errorf("expected token file to be removed, got %v", err)
+		}
+	}()
+	qctx, qcancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer qcancel()
+	var s *ControlStatus
+	for {
+		if s, err = QueryStatus(qctx, addr); err == nil || qctx.Err() != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.State == "" {
+		t.Fatal("expected a state")
+	}
+	fi, err := os.Stat(controlTokenPath(addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("expected token file mode 0600, got %v", fi.Mode().Perm())
+	}
+}
+
+func TestQueryStatusAnyPort(t *testing.T) {
+	c, err := NewClient(&Config{Server: "http://127.0.0.1:1", ControlAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Info = false
+	l, err := listenControl(c.config.ControlAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.serveControl(ctx, l) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	// 令牌文件按实际监听的端口命名
+	qctx, qcancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer qcancel()
+	for {
+		if _, err = QueryStatus(qctx, addr); err == nil || qctx.Err() != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(controlTokenPath("127.0.0.1:0")); !os.IsNotExist(err) {
+		t.Fatalf("expected no token file for port 0, got %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package chclient
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yunfeiyang1916/cloud-chisel/share/tunnel"
+)
+
+func TestDownPolicyUDPQueue(t *testing.T) {
+	queue := tunnel.DownPolicy{Mode: tunnel.DownQueue, QueueSize: 1}
+	tests := []struct {
+		name   string
+		config Config
+		err    bool
+	}{
+		{"default queue", Config{Remotes: []string{"5353:10.0.0.1:53/udp"}, DownPolicy: queue}, true},
+		{"remote queue", Config{
+			Remotes:            []string{"5353:10.0.0.1:53/udp"},
+			RemoteDownPolicies: map[string]tunnel.DownPolicy{"5353:10.0.0.1:53/udp": queue},
+		}, true},
+		{"tcp queue", Config{Remotes: []string{"5353:10.0.0.1:53"}, DownPolicy: queue}, false},
+		{"udp reject", Config{
+			Remotes:    []string{"5353:10.0.0.1:53/udp"},
+			DownPolicy: tunnel.DownPolicy{Mode: tunnel.DownReject},
+		}, false},
+		{"reverse udp queue", Config{Remotes: []string{"R:5353:10.0.0.1:53/udp"}, DownPolicy: queue}, false},
+	}
+	for _, tt := range tests {
+		c := tt.config
+		c.Server = "http://127.0.0.1:1"
+		_, err := NewClient(&c)
+		if tt.err != (err != nil) {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+	}
+}
+
+func TestDialContextDownPolicy(t *testing.T) {
+	c, err := NewClient(&Config{
+		Server:     "http://127.0.0.1:1",
+		DownPolicy: tunnel.DownPolicy{Mode: tunnel.DownReject},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := c.DialContext(ctx, "tcp", "127.0.0.1:80"); err == nil || !strings.Contains(err.Error(), tunnel.DownRejected) {
+		t.Fatalf("expected rejected dial, got %v", err)
+	}
+	c.config.DownPolicy = tunnel.DownPolicy{Timeout: 50 * time.Millisecond}
+	if _, err := c.DialContext(ctx, "tcp", "127.0.0.1:80"); err == nil || !strings.Contains(err.Error(), tunnel.DownTimeout) {
+		t.Fatalf("expected timed out dial, got %v", err)
+	}
+}
+
+func TestUDPRejectKeepsListener(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+	c, err := NewClient(&Config{
+		Server:        "http://127.0.0.1:1",
+		Remotes:       []string{addr + ":10.0.0.1:53/udp"},
+		DownPolicy:    tunnel.DownPolicy{Mode: tunnel.DownReject},
+		MaxRetryCount: -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Info = false
+	if err := c.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < 3; i++ {
+		conn.Write([]byte("ping"))
+		time.Sleep(100 * time.Millisecond)
+	}
+	// 被拒绝的数据包只是被丢弃，监听仍然占用该端口
+	if pc, err := net.ListenPacket("udp", addr); err == nil {
+		pc.Close()
+		t.Fatal("expected the udp listener to still be running")
+	}
+}
+
+func TestDownPolicyStats(t *testing.T) {
+	tests := []struct {
+		name  string
+		proto string
+	}{
+		{"tcp", "tcp"},
+		{"udp", "udp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var addr, remote string
+			if tt.proto == "udp" {
+				pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				addr = pc.LocalAddr().String()
+				pc.Close()
+				remote = addr + ":10.0.0.1:53/udp"
+			} else {
+				l, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				addr = l.Addr().String()
+				l.Close()
+				remote = addr + ":10.0.0.1:80"
+			}
+			c, err := NewClient(&Config{
+				Server:        "http://127.0.0.1:1",
+				Remotes:       []string{remote},
+				DownPolicy:    tunnel.DownPolicy{Mode: tunnel.DownReject},
+				MaxRetryCount: -1,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.Info = false
+			if err := c.Start(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			// 隧道未连接时到达的连接和数据包都按策略拒绝并计数
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				if conn, err := net.Dial(tt.proto, addr); err == nil {
+					conn.Write([]byte("ping"))
+					conn.Close()
+				}
+				rs := c.ControlStatus().Remotes
+				if len(rs) == 1 && rs[0].Down[tunnel.DownRejected] > 0 {
+					if rs[0].Open != 0 {
+						t.Fatalf("expected no open forwards, got %d", rs[0].Open)
+					}
+					return
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("expected rejected forwards, got %+v", rs)
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package chclient
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/yunfeiyang1916/cloud-chisel/share/settings"
+)
+
+// AuthError 服务端拒绝了客户端的用户名或密码
+type AuthError struct {
+	Message string
+}
+
+func (e *AuthError) Error() string {
+	return "authentication failed: " + e.Message
+}
+
+// AccessDenied 用户无权使用请求的远程映射，或者服务端未启用对应的功能
+type AccessDenied struct {
+	Message string
+}
+
+func (e *AccessDenied) Error() string {
+	return "access denied: " + e.Message
+}
+
+// PortInUse 服务端无法监听反向映射的端口
+type PortInUse struct {
+	Message string
+	// 服务端建议的重试等待时长，没有建议时为0
+	RetryAfter time.Duration
+}
+
+func (e *PortInUse) Error() string {
+	return "port in use: " + e.Message
+}
+
+// VersionRejected 服务端的版本策略不接受客户端的版本
+type VersionRejected struct {
+	Message string
+}
+
+func (e *VersionRejected) Error() string {
+	return "version rejected: " + e.Message
+}
+
+// RejectedError 服务端以其他原因拒绝了配置请求
+type RejectedError struct {
+	Code      string
+	Message   string
+	Retryable bool
+	// 服务端建议的重试等待时长，没有建议时为0
+	RetryAfter time.Duration
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("rejected (%s): %s", e.Code, e.Message)
+}
+
+// replyError 将服务端对请求的拒绝回复转换为错误，并返回是否可以重试。
+// 旧版本服务端只回复错误信息，不可重试
+func replyError(reply []byte) (retry bool, err error) {
+	r, derr := settings.DecodeRejection(reply)
+	if derr != nil || r.Code == "" {
+		return false, errors.New(string(reply))
+	}
+	return r.Retryable, rejectionError(r)
+}
+
+// 将服务端的拒绝回复转换为对应的错误类型
+func rejectionError(r *settings.Rejection) error {
+	retryAfter := time.Duration(r.RetryAfter) * time.Second
+	switch r.Code {
+	case settings.RejectAccessDenied:
+		return &AccessDenied{Message: r.Message}
+	case settings.RejectPortInUse:
+		return &PortInUse{Message: r.Message, RetryAfter: retryAfter}
+	case settings.RejectVersion:
+		return &VersionRejected{Message: r.Message}
+	}
+	return &RejectedError{Code: r.Code, Message: r.Message, Retryable: r.Retryable, RetryAfter: retryAfter}
+}
+
+// ServerBusy 服务端(或者前面的代理)以 HTTP 429 或 503 拒绝了websocket连接
+type ServerBusy struct {
+	Status string
+	// Retry-After 响应头建议的重试等待时长，没有建议时为0
+	RetryAfter time.Duration
+}
+
+func (e *ServerBusy) Error() string {
+	return "server busy: " + e.Status
+}
+
+// 从websocket握手的响应中识别服务端繁忙
+func busyError(resp *http.Response) error {
+	if resp == nil || (resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable) {
+		return nil
+	}
+	e := &ServerBusy{Status: resp.Status}
+	if v := resp.Header.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+			e.RetryAfter = time.Duration(secs) * time.Second
+		} else if t, err := http.ParseTime(v); err == nil {
+			e.RetryAfter = time.Until(t)
+		}
+	}
+	return e
+}
+
+// 错误中携带的服务端建议的重试等待时长
+func retryAfter(err error) time.Duration {
+	var busy *ServerBusy
+	var piu *PortInUse
+	var rej *RejectedError
+	switch {
+	case errors.As(err, &busy):
+		return busy.RetryAfter
+	case errors.As(err, &piu):
+		return piu.RetryAfter
+	case errors.As(err, &rej):
+		return rej.RetryAfter
+	}
+	return 0
+}
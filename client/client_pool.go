@@ -0,0 +1,74 @@
+package chclient
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/yunfeiyang1916/cloud-chisel/share/cio"
+	"github.com/yunfeiyang1916/cloud-chisel/share/settings"
+	"golang.org/x/crypto/ssh"
+)
+
+// poolLoop 维持连接池中的一个辅助连接，断开后独立重连，直到客户端关闭。
+// 辅助连接只承载客户端打开的通道，反向映射的连接仍然经由主连接
+func (c *Client) poolLoop(ctx context.Context, member int) error {
+	l := c.Fork("pool#%d", member)
+	b := c.newBackoff()
+	for {
+		connected, err := c.poolConnectOnce(ctx, l, member)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if connected {
+			b.Reset()
+		}
+		if err != nil && err != io.EOF && !strings.HasSuffix(err.Error(), "EOF") {
+			l.Infof("Connection error: %s", err)
+		}
+		d := c.retryDelay(b, err, 0)
+		l.Debugf("Retrying in %s...", d)
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// 建立一个辅助连接并交给隧道使用，阻塞直到连接断开
+func (c *Client) poolConnectOnce(ctx context.Context, l *cio.Logger, member int) (connected bool, err error) {
+	// BindSSH 会等待ctx结束，每个连接使用单独的ctx，断开后随之释放
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	conn, _, err := c.dialServer(ctx)
+	if err != nil {
+		return false, err
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, "", c.sshConfig)
+	if err != nil {
+		return false, err
+	}
+	defer sshConn.Close()
+	// 辅助连接不发送反向映射，以免服务端重复监听
+	config := c.currentConfig()
+	config.Remotes = config.Remotes.Reversed(false)
+	config.PoolMember = member
+	ok, reply, err := sshConn.SendRequest("config", true, settings.EncodeConfig(config))
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		_, err := replyError(reply)
+		return false, err
+	}
+	l.Infof("Connected")
+	t0 := time.Now()
+	atomic.AddInt32(&c.poolConnected, 1)
+	err = c.tunnel.BindSSH(ctx, sshConn, reqs, chans)
+	atomic.AddInt32(&c.poolConnected, -1)
+	l.Infof("Disconnected")
+	return time.Since(t0) > 5*time.Second, err
+}
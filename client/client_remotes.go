@@ -0,0 +1,148 @@
+package chclient
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/yunfeiyang1916/cloud-chisel/share/settings"
+	"golang.org/x/crypto/ssh"
+)
+
+// 当前的远程映射
+func (c *Client) remotes() settings.Remotes {
+	c.remotesMut.RLock()
+	defer c.remotesMut.RUnlock()
+	return c.computed.Remotes
+}
+
+// 替换远程映射，同时更新隧道的转发信息
+func (c *Client) setRemotes(remotes settings.Remotes) {
+	c.remotesMut.Lock()
+	c.computed.Remotes = remotes
+	c.remotesMut.Unlock()
+	c.tunnel.SetRemotes(remotes)
+}
+
+// 发送给服务端的配置
+func (c *Client) currentConfig() settings.Config {
+	c.remotesMut.RLock()
+	defer c.remotesMut.RUnlock()
+	return c.computed
+}
+
+// AddRemote 在运行中的客户端上添加远程映射，形式与 Config.Remotes 相同，不需要重连。
+// 已连接时先由服务端检查权限，反向映射由服务端开始监听，其他映射在本地开始监听；
+// 未连接时在下次连接的配置中发送给服务端
+func (c *Client) AddRemote(remote string) error {
+	r, err := settings.DecodeRemote(remote)
+	if err != nil {
+		return fmt.Errorf("Failed to decode remote '%s': %s", remote, err)
+	}
+	if r.Stdio {
+		return errors.New("stdio remote cannot be added at runtime")
+	}
+	if r.Reverse && r.Socks && !c.tunnel.Socks {
+		return errors.New("reverse socks remote must be configured before Start")
+	}
+	if err := c.checkDownPolicy(r); err != nil {
+		return err
+	}
+	c.updateMut.Lock()
+	defer c.updateMut.Unlock()
+	current := c.remotes()
+	for _, existing := range current {
+		if existing.Encode() == r.Encode() {
+			return fmt.Errorf("remote %s already exists", r)
+		}
+	}
+	conn, err := c.remotesConn()
+	if err != nil {
+		return err
+	}
+	// 先在本地加入映射再请求服务端，服务端收到请求后可能立即转发连接，
+	// 此时本地的目标检查需要已经允许该映射
+	remotes := make(settings.Remotes, 0, len(current)+1)
+	c.setRemotes(append(append(remotes, current...), r))
+	if conn != nil {
+		if err := c.remoteRequest(conn, "remote-add", r); err != nil {
+			c.setRemotes(current)
+			return err
+		}
+	}
+	// 启动后添加的本地映射需要自行监听，启动前添加的由 Start 统一监听
+	if !r.Reverse && c.ctx != nil {
+		if err := c.tunnel.BindRemote(c.ctx, r); err != nil {
+			if conn != nil {
+				c.remoteRequest(conn, "remote-remove", r)
+			}
+			c.setRemotes(current)
+			return err
+		}
+	}
+	c.Infof("Added remote %s", r)
+	return nil
+}
+
+// RemoveRemote 在运行中的客户端上移除远程映射，不需要重连
+func (c *Client) RemoveRemote(remote string) error {
+	r, err := settings.DecodeRemote(remote)
+	if err != nil {
+		return fmt.Errorf("Failed to decode remote '%s': %s", remote, err)
+	}
+	c.updateMut.Lock()
+	defer c.updateMut.Unlock()
+	current := c.remotes()
+	remotes := make(settings.Remotes, 0, len(current))
+	for _, existing := range current {
+		if existing.Encode() != r.Encode() {
+			remotes = append(remotes, existing)
+		}
+	}
+	if len(remotes) == len(current) {
+		return fmt.Errorf("remote %s not found", r)
+	}
+	conn, err := c.remotesConn()
+	if err != nil {
+		return err
+	}
+	if conn != nil {
+		if err := c.remoteRequest(conn, "remote-remove", r); err != nil {
+			return err
+		}
+	}
+	if !r.Reverse {
+		c.tunnel.UnbindRemote(r)
+	} else {
+		// Listen 创建的监听器随远程映射一起关闭
+		c.tunnel.CloseListener(r.Remote())
+	}
+	c.setRemotes(remotes)
+	c.Infof("Removed remote %s", r)
+	return nil
+}
+
+// 返回当前会话的SSH连接，未连接时为nil，服务端不支持运行中增删远程映射时返回错误
+func (c *Client) remotesConn() (ssh.Conn, error) {
+	c.sessMut.RLock()
+	defer c.sessMut.RUnlock()
+	if c.sess == nil {
+		return nil, nil
+	}
+	if !c.sess.caps.Has(settings.CapRemotes) {
+		return nil, errors.New("server does not support changing remotes at runtime")
+	}
+	return c.sess.conn, nil
+}
+
+// 向服务端发送增删远程映射的请求，服务端拒绝时返回对应的错误类型
+func (c *Client) remoteRequest(conn ssh.Conn, typ string, r *settings.Remote) error {
+	ok, reply, err := conn.SendRequest(typ, true, []byte(r.Encode()))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		_, err := replyError(reply)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package chclient
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/yunfeiyang1916/cloud-chisel/share/settings"
+)
+
+func testRetryClient(t *testing.T, c *Config) *Client {
+	t.Helper()
+	c.Server = "http://127.0.0.1:1"
+	client, err := NewClient(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestBackoff(t *testing.T) {
+	c := testRetryClient(t, &Config{
+		MinRetryInterval: time.Second,
+		MaxRetryInterval: 4 * time.Second,
+		RetryFactor:      2,
+	})
+	b := c.newBackoff()
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		if got := c.retryDelay(b, nil, 0); got != want {
+			t.Fatalf("attempt %d: expected %s, got %s", i, want, got)
+		}
+	}
+	b.Reset()
+	if got := c.retryDelay(b, nil, 0); got != time.Second {
+		t.Fatalf("expected %s after reset, got %s", time.Second, got)
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	c := testRetryClient(t, &Config{
+		MinRetryInterval: time.Second,
+		MaxRetryInterval: 8 * time.Second,
+		RetryJitter:      true,
+	})
+	b := c.newBackoff()
+	for i := 0; i < 10; i++ {
+		if d := c.retryDelay(b, nil, 0); d < time.Second || d > 8*time.Second {
+			t.Fatalf("attempt %d: %s out of range", i, d)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	c := testRetryClient(t, &Config{
+		MinRetryInterval: time.Second,
+		MaxRetryInterval: time.Minute,
+	})
+	tests := []struct {
+		err  error
+		want time.Duration
+	}{
+		// 建议值比backoff长
+		{&ServerBusy{RetryAfter: 30 * time.Second}, 30 * time.Second},
+		// 建议值不超过 MaxRetryInterval
+		{&ServerBusy{RetryAfter: time.Hour}, time.Minute},
+		{rejectionError(&settings.Rejection{Code: settings.RejectLimit, RetryAfter: 3600}), time.Minute},
+		{rejectionError(&settings.Rejection{Code: settings.RejectPortInUse, RetryAfter: 10}), 10 * time.Second},
+		// 建议值比backoff短时使用backoff
+		{&ServerBusy{RetryAfter: time.Millisecond}, time.Second},
+		{fmt.Errorf("wrapped: %w", &ServerBusy{RetryAfter: 5 * time.Second}), 5 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := c.retryDelay(c.newBackoff(), tt.err, 0); got != tt.want {
+			t.Errorf("%v: expected %s, got %s", tt.err, tt.want, got)
+		}
+	}
+}
+
+func TestBusyRetryAfterHeader(t *testing.T) {
+	resp := &http.Response{Status: "429 Too Many Requests", StatusCode: 429, Header: http.Header{}}
+	resp.Header.Set("Retry-After", "7")
+	if got := retryAfter(busyError(resp)); got != 7*time.Second {
+		t.Fatalf("expected 7s, got %s", got)
+	}
+	resp.StatusCode = 502
+	if err := busyError(resp); err != nil {
+		t.Fatalf("expected no busy error for 502, got %v", err)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	c := testRetryClient(t, &Config{
+		MinRetryInterval:        time.Second,
+		MaxRetryInterval:        time.Minute,
+		CircuitBreakerThreshold: 3,
+		CircuitBreakerPause:     10 * time.Minute,
+	})
+	c.Info = false
+	b := c.newBackoff()
+	if got := c.retryDelay(b, &AuthError{}, 2); got != time.Second {
+		t.Fatalf("expected backoff below the threshold, got %s", got)
+	}
+	// 熔断暂停不受 MaxRetryInterval 限制
+	if got := c.retryDelay(b, &AuthError{}, 3); got != 10*time.Minute {
+		t.Fatalf("expected circuit breaker pause, got %s", got)
+	}
+	// 未设置阈值时不熔断
+	c.config.CircuitBreakerThreshold = 0
+	if got := c.retryDelay(b, &AuthError{}, 100); got >= time.Minute {
+		t.Fatalf("expected no circuit breaker, got %s", got)
+	}
+}
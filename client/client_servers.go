@@ -0,0 +1,132 @@
+package chclient
+
+import (
+	"math/rand"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ServerEndpoint 候选的 chisel server
+type ServerEndpoint struct {
+	// chisel server url
+	URL string
+	// 可选的服务端指纹，为空时使用 Config.Fingerprint
+	Fingerprint string
+}
+
+// 选择服务端的策略
+const (
+	// StrategyFailover 按顺序优先连接靠前的服务端，失败后切换到下一个，会话结束后重新从第一个开始
+	StrategyFailover = "failover"
+	// StrategyRandom 随机选择服务端，失败后随机切换到另一个
+	StrategyRandom = "random"
+)
+
+// 规范化服务端地址，转换成websocket url
+func serverURL(server, wsPath string) (*url.URL, error) {
+	if !strings.HasPrefix(server, "http") {
+		server = "http://" + server
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+	// 拼接websocket端点路径
+	if wsPath != "" {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.TrimPrefix(wsPath, "/")
+	}
+	// 将http替换成ws协议
+	u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+	if !regexp.MustCompile(`:\d+$`).MatchString(u.Host) {
+		if u.Scheme == "wss" {
+			u.Host = u.Host + ":443"
+		} else {
+			u.Host = u.Host + ":80"
+		}
+	}
+	return u, nil
+}
+
+// 候选服务端
+type endpoint struct {
+	url         string
+	fingerprint string
+}
+
+// serverPool 按策略在候选服务端之间切换
+type serverPool struct {
+	mut      sync.Mutex
+	list     []endpoint
+	strategy string
+	// 切换前允许的连续失败次数
+	failoverAfter int
+	current       int
+	failures      int
+}
+
+func newServerPool(list []endpoint, strategy string, failoverAfter int) *serverPool {
+	if failoverAfter <= 0 {
+		failoverAfter = 1
+	}
+	p := &serverPool{list: list, strategy: strategy, failoverAfter: failoverAfter}
+	if strategy == StrategyRandom {
+		p.current = rand.Intn(len(list))
+	}
+	return p
+}
+
+// 当前使用的服务端
+func (p *serverPool) active() endpoint {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	return p.list[p.current]
+}
+
+// 连接失败，连续失败达到次数后切换服务端，返回是否切换
+func (p *serverPool) failed() bool {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	p.failures++
+	if len(p.list) == 1 || p.failures < p.failoverAfter {
+		return false
+	}
+	p.failures = 0
+	if p.strategy == StrategyRandom {
+		next := rand.Intn(len(p.list) - 1)
+		if next >= p.current {
+			next++
+		}
+		p.current = next
+	} else {
+		p.current = (p.current + 1) % len(p.list)
+	}
+	return true
+}
+
+// 当前服务端不可重试(比如认证失败或者被拒绝)，不等待连续失败次数，按顺序切换到下一个服务端。
+// 随机策略下同样按顺序切换，保证依次尝试所有服务端
+func (p *serverPool) skip() {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	p.failures = 0
+	p.current = (p.current + 1) % len(p.list)
+}
+
+// 候选服务端的数量
+func (p *serverPool) size() int {
+	return len(p.list)
+}
+
+// 会话正常结束，按顺序切换的策略重新从第一个服务端开始，返回是否切换
+func (p *serverPool) succeeded() bool {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	p.failures = 0
+	if p.strategy == StrategyRandom || p.current == 0 {
+		return false
+	}
+	p.current = 0
+	return true
+}
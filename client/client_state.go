@@ -0,0 +1,169 @@
+package chclient
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// State 客户端的连接状态
+type State int
+
+const (
+	// StateConnecting 正在连接服务端(包括重连)
+	StateConnecting State = iota
+	// StateConnected 已通过配置握手，隧道可用
+	StateConnected
+	// StateDisconnected 连接已断开或连接失败，等待重试
+	StateDisconnected
+	// StateGaveUp 已放弃重试或已被取消，客户端不会再连接
+	StateGaveUp
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateGaveUp:
+		return "given-up"
+	}
+	return "unknown"
+}
+
+// Status 客户端连接状态的快照
+type Status struct {
+	State State
+	// 状态变化的时间
+	Since time.Time
+	// 最后一次连接错误，没有错误时为nil
+	Err error
+	// 当前连接的延迟，有保活ping的样本时为平滑的往返时间，未连接时为0
+	Latency time.Duration
+	// 保活ping往返时间的平均偏差，未连接时为0
+	Jitter time.Duration
+	// 正在连接或者已连接的服务端
+	Server string
+	// 连接池中已连接的辅助连接数量和配置的辅助连接数量，未使用连接池时都为0
+	PoolConnected, PoolSize int
+}
+
+// 连接状态及其订阅者
+type stateWatch struct {
+	mut      sync.Mutex
+	status   Status
+	ready    chan struct{}
+	done     chan struct{}
+	watchers []chan Status
+}
+
+func newStateWatch() *stateWatch {
+	return &stateWatch{
+		status: Status{State: StateConnecting, Since: time.Now()},
+		ready:  make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// 更新状态并通知订阅者，放弃重试后不再更新
+func (w *stateWatch) set(state State, err error, latency time.Duration) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	if w.status.State == StateGaveUp {
+		return
+	}
+	prev := w.status.State
+	w.status = Status{State: state, Since: time.Now(), Err: err, Latency: latency, Server: w.status.Server}
+	if state == StateConnected && prev != StateConnected {
+		close(w.ready)
+	} else if state != StateConnected && prev == StateConnected {
+		w.ready = make(chan struct{})
+	}
+	for _, ch := range w.watchers {
+		// 订阅者处理不及时，丢弃最旧的状态
+		select {
+		case ch <- w.status:
+		default:
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- w.status
+		}
+	}
+	if state == StateGaveUp {
+		close(w.done)
+		for _, ch := range w.watchers {
+			close(ch)
+		}
+		w.watchers = nil
+	}
+}
+
+// 更新当前的服务端，在下次状态变化时通知订阅者
+func (w *stateWatch) setServer(server string) {
+	w.mut.Lock()
+	w.status.Server = server
+	w.mut.Unlock()
+}
+
+// Status 返回客户端当前的连接状态
+func (c *Client) Status() Status {
+	c.state.mut.Lock()
+	st := c.state.status
+	c.state.mut.Unlock()
+	if st.State == StateConnected {
+		if rtt := c.tunnel.RTT(); rtt.Samples > 0 {
+			st.Latency = rtt.Smoothed
+			st.Jitter = rtt.Jitter
+		}
+	}
+	if n := c.config.Connections; n > 1 {
+		st.PoolConnected = int(atomic.LoadInt32(&c.poolConnected))
+		st.PoolSize = n - 1
+	}
+	return st
+}
+
+// Ready 返回隧道当前是否可用
+func (c *Client) Ready() bool {
+	return c.Status().State == StateConnected
+}
+
+// WaitReady 阻塞直到隧道可用。客户端放弃重试时返回最后一次的连接错误
+func (c *Client) WaitReady(ctx context.Context) error {
+	c.state.mut.Lock()
+	ready, done := c.state.ready, c.state.done
+	c.state.mut.Unlock()
+	select {
+	case <-ready:
+		return nil
+	case <-done:
+		if err := c.Status().Err; err != nil {
+			return err
+		}
+		return errors.New("client gave up")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// StateChanges 返回接收连接状态变化的通道，客户端放弃重试后通道被关闭。
+// 接收不及时时只保留最新的状态
+func (c *Client) StateChanges() <-chan Status {
+	ch := make(chan Status, 1)
+	c.state.mut.Lock()
+	defer c.state.mut.Unlock()
+	if c.state.status.State == StateGaveUp {
+		ch <- c.state.status
+		close(ch)
+		return ch
+	}
+	c.state.watchers = append(c.state.watchers, ch)
+	return ch
+}
@@ -5,7 +5,7 @@ import (
 	"log"
 	"time"
 
-	"github.com/yunfeiyang1916/cloud-chisel/share/cio"
+	"github.com/yunfeiyang1916/cloud-chisel/share/events"
 
 	chclient "github.com/yunfeiyang1916/cloud-chisel/client"
 )
@@ -18,11 +18,13 @@ func main() {
 		KeepAlive:        25 * time.Second,
 		MaxRetryInterval: time.Minute,
 		MaxRetryCount:    -1,
-		OnForwardingConnect: func(localPort string, logger *cio.Logger) {
-			logger.Infof("%s 转发打开", localPort)
-		},
-		OnForwardingClose: func(localPort string, logger *cio.Logger) {
-			logger.Infof("%s 转发关闭", localPort)
+		OnEvent: func(e *events.Event) {
+			switch e.Type {
+			case events.ForwardOpened:
+				log.Println(e.Forward.Target, "转发打开")
+			case events.ForwardClosed:
+				log.Println(e.Forward.Target, "转发关闭")
+			}
 		},
 	}
 	//testProxy(c)
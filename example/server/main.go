@@ -2,8 +2,7 @@ package main
 
 import (
 	"context"
-	"github.com/yunfeiyang1916/cloud-chisel/share/cio"
-	"github.com/yunfeiyang1916/cloud-chisel/share/tunnel"
+	"github.com/yunfeiyang1916/cloud-chisel/share/events"
 	"log"
 
 	chserver "github.com/yunfeiyang1916/cloud-chisel/server"
@@ -13,17 +12,17 @@ func main() {
 	config := &chserver.Config{
 		AuthFile: "config/users.json",
 		Reverse:  true,
-		OnConnect: func(localPort, remotePort string, tun *tunnel.Tunnel) {
-			log.Println(localPort, "隧道建立")
-		},
-		OnClose: func(localPort string) {
-			log.Println(localPort, "隧道关闭")
-		},
-		OnForwardingConnect: func(localPort string, logger *cio.Logger) {
-			logger.Infof("%s 转发打开", localPort)
-		},
-		OnForwardingClose: func(localPort string, logger *cio.Logger) {
-			logger.Infof("%s 转发关闭", localPort)
+		OnEvent: func(e *events.Event) {
+			switch e.Type {
+			case events.SessionStarted:
+				log.Println(e.User, e.Remotes.Encode(), "隧道建立")
+			case events.SessionEnded:
+				log.Println(e.User, e.Remotes.Encode(), "隧道关闭")
+			case events.ForwardOpened:
+				log.Println(e.Forward.Target, "转发打开")
+			case events.ForwardClosed:
+				log.Println(e.Forward.Target, "转发关闭")
+			}
 		},
 	}
 	//useProxy(config)
@@ -1,4 +1,76 @@
 package main
 
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jpillora/sizestr"
+	chclient "github.com/yunfeiyang1916/cloud-chisel/client"
+)
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "status" {
+		status(os.Args[2:])
+	}
+}
+
+// status 通过客户端的控制API打印运行状态
+func status(args []string) {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	control := flags.String("control", os.Getenv("CHISEL_CONTROL"), "client control API address, unix:<path> or <host>:<port>")
+	asJSON := flags.Bool("json", false, "print the raw JSON status")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: chisel status [--json] --control <addr>\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *control == "" {
+		flags.Usage()
+		os.Exit(1)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, err := chclient.QueryStatus(ctx, *control)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *asJSON {
+		b, _ := json.MarshalIndent(s, "", "  ")
+		fmt.Println(string(b))
+		return
+	}
+	fmt.Printf("state:       %s (since %s)\n", s.State, s.Since.Format(time.RFC3339))
+	fmt.Printf("server:      %s\n", s.Server)
+	if s.Fingerprint != "" {
+		fmt.Printf("fingerprint: %s\n", s.Fingerprint)
+	}
+	if s.Latency > 0 {
+		fmt.Printf("latency:     %s (jitter %s)\n", s.Latency, s.Jitter)
+	}
+	if s.PoolSize > 0 {
+		fmt.Printf("pool:        %d/%d connected\n", s.PoolConnected, s.PoolSize)
+	}
+	if s.MissedPings > 0 {
+		fmt.Printf("missed pings: %d\n", s.MissedPings)
+	}
+	if s.Error != "" {
+		fmt.Printf("last error:  %s\n", s.Error)
+	}
+	fmt.Printf("remotes:\n")
+	for _, r := range s.Remotes {
+		fmt.Printf("  %s open=%d total=%d sent=%s received=%s\n", r.Remote, r.Open, r.Total,
+			sizestr.ToString(r.Sent), sizestr.ToString(r.Received))
+		for outcome, n := range r.Down {
+			fmt.Printf("    while down: %s=%d\n", outcome, n)
+		}
+	}
+	fmt.Printf("connections: %d\n", len(s.Connections))
+	for _, c := range s.Connections {
+		fmt.Printf("  %s %s => %s (%s)\n", c.Proto, c.Source, c.Target, time.Since(c.Start).Round(time.Second))
+	}
 }
@@ -8,16 +8,19 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/jpillora/requestlog"
 	chshare "github.com/yunfeiyang1916/cloud-chisel/share"
+	"github.com/yunfeiyang1916/cloud-chisel/share/audit"
 	"github.com/yunfeiyang1916/cloud-chisel/share/ccrypto"
 	"github.com/yunfeiyang1916/cloud-chisel/share/cio"
 	"github.com/yunfeiyang1916/cloud-chisel/share/cnet"
+	"github.com/yunfeiyang1916/cloud-chisel/share/events"
 	"github.com/yunfeiyang1916/cloud-chisel/share/settings"
-	"github.com/yunfeiyang1916/cloud-chisel/share/tunnel"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -28,12 +31,24 @@ type Config struct {
 	// 当使用<user>连接时，<pass>将被验证，然后每个远程地址将与列表进行正则匹配
 	// 普通远程地址形式：<remote-host>:<remote-port>
 	// 用于反向端口转发远程地址形式：R:<local-interface>:<local-port>
+	// 发布服务形式：R:svc:<name>，使用服务形式：svc:<name>，别名形式：@<name>
+	// 值也可以是对象 {"addrs": ["<addr-regex>"], "labels": {"<key>": "<value-regex>"}}，
+	// 设置labels后客户端只能携带列出的标签，且标签值必须匹配对应的正则
 	AuthFile string
 	// 形式为：<user:pass>，可选。
 	// 等价于authfile {"<user:pass>": [""]},如果未设置，则将使用AUTH环境变量
 	Auth string
 	// 代理
 	Proxy string
+	// 可选的路径前缀，比如 /chisel，设置后只处理该前缀下的请求(包括 /health 和 /version)，
+	// 用于将 Handler 挂载到其他HTTP服务器的路由中
+	PathPrefix string
+	// 可选的websocket端点路径(位于 PathPrefix 之下)，比如 /tunnel，
+	// 设置后其他路径上的websocket升级请求返回404
+	WebSocketPath string
+	// 可选的自定义请求头名称，比如 X-Chisel-Protocol，
+	// 当入口网关不转发 Sec-WebSocket-Protocol 时，也接受从该请求头中读取协议版本
+	ProtocolHeader string
 	// 是否允许客户端访问内部的SOCKS5代理
 	Socks5 bool
 	// 反向端口转发，是否允许客户端指定反向端口转发
@@ -41,14 +56,48 @@ type Config struct {
 	// 可选的保活间隔。 由于底层传输是HTTP，在许多情况下我们将遍历代理，这些代理通常会关闭空闲连接。
 	// 您必须使用单位指定时间，例如“5s”或“2m”。 默认为“25s”（设置为 0s 以禁用）。
 	KeepAlive time.Duration
+	// 等待保活pong的超时时间，默认与 KeepAlive 相同
+	KeepAliveTimeout time.Duration
+	// 连续错过多少次保活ping后认为客户端已断开并关闭会话，默认为1
+	KeepAliveMaxMissed int
+	// 可选的websocket ping帧间隔，超过 KeepAliveMaxMissed 个间隔没有收到pong时关闭会话。默认为0(禁用)
+	WebSocketPing time.Duration
+	// 每个用户的并发会话数量上限，0表示不限制。同一客户端连接池的并行连接只计为一个会话
+	MaxSessionsPerUser int
+	// 每个客户端连接池的并行连接数量上限，默认为64
+	MaxPoolConnections int
+	// 每个会话的并发通道数量上限，0表示不限制
+	MaxChannelsPerSession int
+	// 每个会话每秒新建连接数量上限，0表示不限制
+	MaxConnectionsPerSecond float64
+	// 可选的目标别名，键为别名，值为实际的目标地址 <host>:<port>。
+	// 客户端以 <local-port>:@<name> 使用别名，不需要知道实际地址，用户的访问控制按 @<name> 匹配
+	Aliases map[string]string
+	// 可选的建议重试等待时长，以可重试的原因拒绝客户端时告知客户端，避免大量客户端同时重连
+	RetryAfter time.Duration
+	// 允许的最低客户端版本(语义化版本号)，低于该版本的客户端将被拒绝并提示升级
+	MinClientVersion string
+	// 允许的最高客户端版本(语义化版本号)
+	MaxClientVersion string
+	// 允许的客户端版本列表，设置后只接受列出的版本，忽略最低和最高版本
+	AllowedClientVersions []string
+	// 可选的审计日志文件路径，设置后以JSON lines格式记录登录、会话和转发连接
+	AuditLog string
+	// 审计日志文件的轮转大小，单位MB，默认为100
+	AuditLogMaxSize int
+	// 保留的历史审计日志文件数量，默认为5
+	AuditLogMaxBackups int
+	// 可选的webhook地址列表，会话连接和断开、反向端口绑定和解绑、认证失败时以POST方式发送JSON，
+	// 失败时按退避策略重试
+	Webhooks []string
+	// 可选的webhook签名密钥，设置后每个请求携带 X-Chisel-Timestamp: <unix秒> 和
+	// X-Chisel-Signature: sha256=<HMAC-SHA256的十六进制>，签名内容为 <timestamp>.<body>，
+	// 接收方应拒绝时间戳过旧的请求以防止重放
+	WebhookSecret string
 	// 传输层安全协议的设置
-	TLS       TLSConfig
-	OnConnect func(localPort, remotePort string, tun *tunnel.Tunnel)
-	OnClose   func(localPort string)
-	// 使用隧道转发请求时创建连接的回调
-	OnForwardingConnect func(localPort string, logger *cio.Logger)
-	// 使用隧道转发请求时结束连接的回调
-	OnForwardingClose func(localPort string, logger *cio.Logger)
+	TLS TLSConfig
+	// 会话和转发连接的事件回调
+	OnEvent events.Handler
 }
 
 type Server struct {
@@ -64,10 +113,23 @@ type Server struct {
 	// session数量
 	sessCount int32
 	// 会话
-	sessions  *settings.Users
+	sessions *settings.Users
+	// 活跃会话索引
+	active    *sessionIndex
 	sshConfig *ssh.ServerConfig
 	// 可重载的用户源配置
 	users *settings.UserIndex
+	// 审计日志，未启用时为nil
+	audit *audit.Log
+	// webhook通知，未配置时为nil
+	webhooks *webhooks
+	// 客户端版本限制
+	versions *settings.VersionPolicy
+	// 客户端发布的服务
+	services *serviceIndex
+	// 目标别名
+	aliasesMut sync.RWMutex
+	aliases    map[string]string
 }
 
 // 升级器，将http连接升级成websocket
@@ -84,8 +146,16 @@ func NewServer(c *Config) (*Server, error) {
 		httpServer: cnet.NewHTTPServer(),
 		Logger:     cio.NewLogger("server"),
 		sessions:   settings.NewUsers(),
+		active:     newSessionIndex(),
+		services:   newServiceIndex(),
 	}
 	server.Info = true
+	if err := server.SetAliases(c.Aliases); err != nil {
+		return nil, err
+	}
+	if p := c.WebSocketPath; p != "" && !strings.HasPrefix(p, "/") {
+		c.WebSocketPath = "/" + p
+	}
 	server.users = settings.NewUserIndex(server.Logger)
 	if c.AuthFile != "" {
 		if err := server.users.LoadUsers(c.AuthFile); err != nil {
@@ -99,6 +169,29 @@ func NewServer(c *Config) (*Server, error) {
 			server.users.AddUser(u)
 		}
 	}
+	// 审计日志
+	if c.AuditLog != "" {
+		size := c.AuditLogMaxSize
+		if size <= 0 {
+			size = 100
+		}
+		backups := c.AuditLogMaxBackups
+		if backups <= 0 {
+			backups = 5
+		}
+		a, err := audit.New(c.AuditLog, int64(size)<<20, backups)
+		if err != nil {
+			return nil, err
+		}
+		server.audit = a
+		server.Infof("Audit log enabled (%s)", c.AuditLog)
+	}
+	versions, err := settings.NewVersionPolicy(c.MinClientVersion, c.MaxClientVersion, c.AllowedClientVersions)
+	if err != nil {
+		return nil, err
+	}
+	server.versions = versions
+	server.webhooks = newWebhooks(server.Logger, c.Webhooks, c.WebhookSecret)
 	// 生成私钥(可选地使用种子)
 	key, err := ccrypto.GenerateKey(c.KeySeed)
 	// 转成ssh私钥
@@ -164,13 +257,20 @@ func (s *Server) StartContext(ctx context.Context, host, port string) error {
 	if err != nil {
 		return err
 	}
+	return s.httpServer.GoServer(ctx, l, s.Handler())
+}
+
+// Handler 返回服务端的 http.Handler，可以挂载到应用已有的HTTP服务器和路由中，
+// 此时由应用管理监听，不需要调用 Start，Wait 也不再适用。
+// 仍然需要调用 Close 停止webhook投递并关闭审计日志
+func (s *Server) Handler() http.Handler {
 	h := http.Handler(http.HandlerFunc(s.handleClientHandler))
 	if s.Debug {
 		o := requestlog.DefaultOptions
 		o.TrustProxy = true
 		h = requestlog.WrapWith(h, o)
 	}
-	return s.httpServer.GoServer(ctx, l, h)
+	return h
 }
 
 // Wait 等待http server关闭
@@ -178,9 +278,18 @@ func (s *Server) Wait() error {
 	return s.httpServer.Wait()
 }
 
-// Close 强制关闭HTTP服务器
+// Close 强制关闭HTTP服务器，停止webhook投递并关闭审计日志。
+// 只通过 Handler 使用、没有调用 Start 时只停止webhook和关闭审计日志
 func (s *Server) Close() error {
-	return s.httpServer.Close()
+	err := s.httpServer.Close()
+	if errors.Is(err, cnet.ErrNotStarted) {
+		err = nil
+	}
+	s.webhooks.close()
+	if aerr := s.audit.Close(); err == nil {
+		err = aerr
+	}
+	return err
 }
 
 // GetFingerprint 获取访问服务器的指纹
@@ -198,14 +307,38 @@ func (s *Server) authUser(c ssh.ConnMetadata, password []byte) (*ssh.Permissions
 	user, found := s.users.Get(n)
 	if !found || user.Pass != string(password) {
 		s.Debugf("Login failed for user: %s", n)
+		s.auditRecord(audit.Event{
+			Type:   audit.LoginFailure,
+			User:   n,
+			Source: c.RemoteAddr().String(),
+		})
+		s.emit(nil, &events.Event{
+			Type:       events.AuthFailed,
+			Time:       time.Now(),
+			User:       n,
+			LocalAddr:  c.LocalAddr().String(),
+			RemoteAddr: c.RemoteAddr().String(),
+		})
 		return nil, errors.New("Invalid authentication for username: %s")
 	}
+	s.auditRecord(audit.Event{
+		Type:   audit.LoginSuccess,
+		User:   n,
+		Source: c.RemoteAddr().String(),
+	})
 	// insert the user session map
 	// TODO 应该加个互斥锁
 	s.sessions.Set(string(c.SessionID()), user)
 	return nil, nil
 }
 
+// 写入审计事件
+func (s *Server) auditRecord(e audit.Event) {
+	if err := s.audit.Record(e); err != nil {
+		s.Infof("Failed to write audit log: %s", err)
+	}
+}
+
 // DeleteUser removes a user from the server user index
 func (s *Server) DeleteUser(user string) {
 	s.users.Del(user)
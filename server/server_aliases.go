@@ -0,0 +1,47 @@
+package chserver
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/yunfeiyang1916/cloud-chisel/share/settings"
+)
+
+// 检查别名的名称和目标地址
+func checkAliases(aliases map[string]string) error {
+	for name, addr := range aliases {
+		if !settings.ValidAliasName(name) {
+			return fmt.Errorf("invalid alias name '%s'", name)
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid alias '%s' target: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// SetAliases 替换全部别名，之后新建的连接使用新的目标地址，已打开的连接不受影响
+func (s *Server) SetAliases(aliases map[string]string) error {
+	if err := checkAliases(aliases); err != nil {
+		return err
+	}
+	copied := make(map[string]string, len(aliases))
+	for name, addr := range aliases {
+		copied[name] = addr
+	}
+	s.aliasesMut.Lock()
+	s.aliases = copied
+	s.aliasesMut.Unlock()
+	return nil
+}
+
+// resolveAlias 返回别名的目标地址
+func (s *Server) resolveAlias(name string) (string, error) {
+	s.aliasesMut.RLock()
+	defer s.aliasesMut.RUnlock()
+	addr, ok := s.aliases[name]
+	if !ok {
+		return "", fmt.Errorf("unknown alias '@%s'", name)
+	}
+	return addr, nil
+}
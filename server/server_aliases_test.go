@@ -0,0 +1,60 @@
+package chserver
+
+import (
+	"errors"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	chclient "github.com/yunfeiyang1916/cloud-chisel/client"
+	"github.com/yunfeiyang1916/cloud-chisel/share/settings"
+)
+
+// 启动带别名的服务端，用户 u 只能访问匹配 addrs 的地址
+func testAliasServer(t *testing.T, aliases map[string]string, addrs string) string {
+	t.Helper()
+	s, url := testServer(t, &Config{Aliases: aliases})
+	s.ResetUsers([]*settings.User{{Name: "u", Pass: "p", Addrs: []*regexp.Regexp{regexp.MustCompile(addrs)}}})
+	return url
+}
+
+func TestAliasForward(t *testing.T) {
+	echo := testEcho(t)
+	url := testAliasServer(t, map[string]string{"db": echo}, `^@db$`)
+	local := "127.0.0.1:" + testPort(t)
+	if _, err := testClient(t, &chclient.Config{Server: url, Auth: "u:p", Remotes: []string{local + ":@db"}}); err != nil {
+		t.Fatal(err)
+	}
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", local); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testRoundTrip(t, conn)
+}
+
+func TestAliasAccessDenied(t *testing.T) {
+	url := testAliasServer(t, map[string]string{"db": "127.0.0.1:5432", "admin": "127.0.0.1:22"}, `^@db$`)
+	_, err := testClient(t, &chclient.Config{Server: url, Auth: "u:p", Remotes: []string{"127.0.0.1:" + testPort(t) + ":@admin"}})
+	var denied *chclient.AccessDenied
+	if !errors.As(err, &denied) {
+		t.Fatalf("expected access denied, got %v", err)
+	}
+}
+
+func TestUnknownAlias(t *testing.T) {
+	url := testAliasServer(t, map[string]string{"db": "127.0.0.1:5432"}, `^@`)
+	_, err := testClient(t, &chclient.Config{Server: url, Auth: "u:p", Remotes: []string{"127.0.0.1:" + testPort(t) + ":@nope"}})
+	var rej *chclient.RejectedError
+	if !errors.As(err, &rej) || rej.Code != settings.RejectInvalidConfig {
+		t.Fatalf("expected invalid config rejection, got %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package chserver
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	chclient "github.com/yunfeiyang1916/cloud-chisel/client"
+)
+
+func TestChain(t *testing.T) {
+	echo := testEcho(t)
+	bastion, bastionURL := testServer(t, &Config{Auth: "b:pw", WebSocketPath: "/tunnel"})
+	_, innerURL := testServer(t, &Config{Auth: "i:pw"})
+	c, err := testClient(t, &chclient.Config{
+		Server: innerURL,
+		Auth:   "i:pw",
+		// 中间服务端使用客户端的 WebSocketPath，内层服务端不限制路径
+		WebSocketPath: "/tunnel",
+		Chain: []chclient.Hop{{
+			Server:      bastionURL,
+			Auth:        "b:pw",
+			Fingerprint: bastion.GetFingerprint(),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(bastion.Sessions()); n != 1 {
+		t.Fatalf("expected 1 session on the bastion, got %d", n)
+	}
+	conn, err := c.DialContext(context.Background(), "tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testRoundTrip(t, conn)
+}
+
+func TestChainHopWebSocketPath(t *testing.T) {
+	_, bastionURL := testServer(t, &Config{WebSocketPath: "/bastion"})
+	_, innerURL := testServer(t, &Config{WebSocketPath: "/inner"})
+	_, err := testClient(t, &chclient.Config{
+		Server:        innerURL,
+		WebSocketPath: "/inner",
+		Chain:         []chclient.Hop{{Server: bastionURL, WebSocketPath: "/bastion"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChainHopAuthFailure(t *testing.T) {
+	_, bastionURL := testServer(t, &Config{Auth: "b:pw"})
+	_, innerURL := testServer(t, &Config{})
+	_, err := testClient(t, &chclient.Config{
+		Server: innerURL,
+		Chain:  []chclient.Hop{{Server: bastionURL, Auth: "b:wrong"}},
+	})
+	var authErr *chclient.AuthError
+	if !errors.As(err, &authErr) || !strings.Contains(err.Error(), "hop") {
+		t.Fatalf("expected hop authentication error, got %v", err)
+	}
+}
+
+func TestChainHopFingerprintMismatch(t *testing.T) {
+	_, bastionURL := testServer(t, &Config{})
+	inner, innerURL := testServer(t, &Config{})
+	_, err := testClient(t, &chclient.Config{
+		Server: innerURL,
+		Chain: []chclient.Hop{{
+			Server:      bastionURL,
+			Fingerprint: inner.GetFingerprint(),
+		}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "Invalid fingerprint") || !strings.Contains(err.Error(), "hop") {
+		t.Fatalf("expected hop fingerprint mismatch, got %v", err)
+	}
+}
@@ -0,0 +1,33 @@
+package chserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/yunfeiyang1916/cloud-chisel/share/cnet"
+	"github.com/yunfeiyang1916/cloud-chisel/share/settings"
+)
+
+// DialSession 经由已连接的客户端连接 addr，由客户端建立到 addr 的连接。
+// session 为会话编号或用户名，使用用户名时选择该用户最新的会话。
+// 客户端需要在 AllowDial 中允许 addr，否则连接被拒绝
+func (s *Server) DialSession(ctx context.Context, session, network, addr string) (net.Conn, error) {
+	sess := s.active.find(session)
+	if sess == nil {
+		return nil, fmt.Errorf("session not found: %s", session)
+	}
+	if !sess.caps.Has(settings.CapDial) {
+		return nil, fmt.Errorf("session %s does not accept dial", sess.sid())
+	}
+	return sess.tunnel.DialContext(ctx, network, addr)
+}
+
+// SessionRoundTripper 返回经由客户端 session 发送HTTP请求的 http.RoundTripper，
+// session 为会话编号或用户名，每次拨号时重新查找会话，因此客户端重连后仍然可用
+func (s *Server) SessionRoundTripper(session string) http.RoundTripper {
+	return cnet.NewTransport(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return s.DialSession(ctx, session, network, addr)
+	})
+}
@@ -0,0 +1,50 @@
+package chserver
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+
+	chclient "github.com/yunfeiyang1916/cloud-chisel/client"
+)
+
+func TestDialSession(t *testing.T) {
+	allowed, other := testEcho(t), testEcho(t)
+	s, url := testServer(t, &Config{Auth: "u:p"})
+	if _, err := testClient(t, &chclient.Config{
+		Server:    url,
+		Auth:      "u:p",
+		AllowDial: []string{"^" + regexp.QuoteMeta(allowed) + "$"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	// 按用户名和会话编号都可以找到会话
+	for _, session := range []string{"u", s.Sessions()[0].ID} {
+		conn, err := s.DialSession(ctx, session, "tcp", allowed)
+		if err != nil {
+			t.Fatalf("%s: %s", session, err)
+		}
+		testRoundTrip(t, conn)
+		conn.Close()
+	}
+	if _, err := s.DialSession(ctx, "u", "tcp", other); err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Fatalf("expected address outside AllowDial to be denied, got %v", err)
+	}
+	if _, err := s.DialSession(ctx, "nobody", "tcp", allowed); err == nil || !strings.Contains(err.Error(), "session not found") {
+		t.Fatalf("expected unknown session error, got %v", err)
+	}
+}
+
+func TestDialSessionWithoutAllowDial(t *testing.T) {
+	echo := testEcho(t)
+	s, url := testServer(t, &Config{Auth: "u:p"})
+	if _, err := testClient(t, &chclient.Config{Server: url, Auth: "u:p"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := s.DialSession(context.Background(), "u", "tcp", echo)
+	if err == nil || !strings.Contains(err.Error(), "does not accept dial") {
+		t.Fatalf("expected dial to be refused, got %v", err)
+	}
+}
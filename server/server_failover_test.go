@@ -0,0 +1,39 @@
+package chserver
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	chclient "github.com/yunfeiyang1916/cloud-chisel/client"
+)
+
+func TestFailoverOnAuthFailure(t *testing.T) {
+	_, bad := testServer(t, &Config{Auth: "u:other"})
+	_, good := testServer(t, &Config{Auth: "u:p"})
+	c, err := testClient(t, &chclient.Config{
+		Server:  bad,
+		Servers: []chclient.ServerEndpoint{{URL: good}},
+		Auth:    "u:p",
+	})
+	if err != nil {
+		t.Fatalf("expected failover to the second server, got %v", err)
+	}
+	if want := "ws" + strings.TrimPrefix(good, "http"); c.Status().Server != want {
+		t.Fatalf("expected to be connected to %s, got %s", want, c.Status().Server)
+	}
+}
+
+func TestFailoverGivesUpAfterAllServers(t *testing.T) {
+	_, a := testServer(t, &Config{Auth: "u:other"})
+	_, b := testServer(t, &Config{Auth: "u:p"})
+	_, err := testClient(t, &chclient.Config{
+		Server:  a,
+		Servers: []chclient.ServerEndpoint{{URL: b}},
+		Auth:    "u:wrong",
+	})
+	var authErr *chclient.AuthError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("expected an authentication error, got %v", err)
+	}
+}
@@ -1,13 +1,17 @@
 package chserver
 
 import (
+	"fmt"
 	"net/http"
+	"sort"
 	"strings"
 	"sync/atomic"
 	"time"
 
 	chshare "github.com/yunfeiyang1916/cloud-chisel/share"
+	"github.com/yunfeiyang1916/cloud-chisel/share/cio"
 	"github.com/yunfeiyang1916/cloud-chisel/share/cnet"
+	"github.com/yunfeiyang1916/cloud-chisel/share/events"
 	"github.com/yunfeiyang1916/cloud-chisel/share/settings"
 	"github.com/yunfeiyang1916/cloud-chisel/share/tunnel"
 	"golang.org/x/crypto/ssh"
@@ -16,11 +20,24 @@ import (
 
 // handleClientHandler 是主要的HTTP websocket处理器
 func (s *Server) handleClientHandler(w http.ResponseWriter, r *http.Request) {
+	// 只处理路径前缀下的请求
+	path, ok := s.stripPrefix(r.URL.Path)
+	if !ok {
+		w.WriteHeader(404)
+		w.Write([]byte("Not found"))
+		return
+	}
 	// 将有chisel前缀的请求升级成websocket
 	upgrade := strings.ToLower(r.Header.Get("Upgrade"))
 	// WebSocket协议版本号
-	protocol := r.Header.Get("Sec-WebSocket-Protocol")
+	protocol := s.protocol(r)
 	if upgrade == "websocket" && strings.HasPrefix(protocol, "chisel-") {
+		// 不在websocket端点路径上
+		if p := s.config.WebSocketPath; p != "" && path != p {
+			w.WriteHeader(404)
+			w.Write([]byte("Not found"))
+			return
+		}
 		if protocol == chshare.ProtocolVersion {
 			// 转成websocket连接处理
 			s.handleWebsocket(w, r)
@@ -35,7 +52,7 @@ func (s *Server) handleClientHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// 未定义代理，判断是否是健康检测或者版本检测
-	switch r.URL.String() {
+	switch path {
 	case "/health":
 		w.Write([]byte("OK\n"))
 		return
@@ -48,6 +65,32 @@ func (s *Server) handleClientHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("Not found"))
 }
 
+// protocol 获取客户端请求的协议版本，优先使用 Sec-WebSocket-Protocol，
+// 其次使用 Config.ProtocolHeader 指定的请求头
+func (s *Server) protocol(r *http.Request) string {
+	protocol := r.Header.Get("Sec-WebSocket-Protocol")
+	if protocol == "" && s.config.ProtocolHeader != "" {
+		protocol = r.Header.Get(s.config.ProtocolHeader)
+	}
+	return protocol
+}
+
+// stripPrefix 去掉 Config.PathPrefix，路径不在前缀下时返回false
+func (s *Server) stripPrefix(path string) (string, bool) {
+	prefix := strings.TrimSuffix(s.config.PathPrefix, "/")
+	if prefix == "" {
+		return path, true
+	}
+	if path != prefix && !strings.HasPrefix(path, prefix+"/") {
+		return "", false
+	}
+	path = strings.TrimPrefix(path, prefix)
+	if path == "" {
+		path = "/"
+	}
+	return path, true
+}
+
 // handleWebsocket 转成websocket连接处理
 func (s *Server) handleWebsocket(w http.ResponseWriter, req *http.Request) {
 	// 递增连接会话数量
@@ -61,6 +104,13 @@ func (s *Server) handleWebsocket(w http.ResponseWriter, req *http.Request) {
 	}
 	// 封装ws连接
 	conn := cnet.NewWebSocketConn(wsConn)
+	if d := s.config.WebSocketPing; d > 0 {
+		missed := s.config.KeepAliveMaxMissed
+		if missed <= 0 {
+			missed = 1
+		}
+		cnet.PingWebSocket(conn, d, missed)
+	}
 	// 进行ssh握手
 	sshConn, chans, reqs, err := ssh.NewServerConn(conn, s.sshConfig)
 	if err != nil {
@@ -90,18 +140,32 @@ func (s *Server) handleWebsocket(w http.ResponseWriter, req *http.Request) {
 		sshConn.Close()
 		return
 	}
-	failed := func(err error) {
+	var c *settings.Config
+	// 拒绝配置请求，支持结构化回复的客户端将收到拒绝原因的代码
+	failed := func(code string, retryable bool, err error) {
 		l.Debugf("Failed: %s", err)
+		if c != nil && c.Capabilities.Has(settings.CapRejectCodes) {
+			rej := settings.Rejection{
+				Code:      code,
+				Message:   err.Error(),
+				Retryable: retryable,
+			}
+			if retryable {
+				rej.RetryAfter = int(s.config.RetryAfter / time.Second)
+			}
+			r.Reply(false, settings.EncodeRejection(rej))
+			return
+		}
 		r.Reply(false, []byte(err.Error()))
 	}
 	// 第一个请求不是config请求
 	if r.Type != "config" {
-		failed(s.Errorf("expecting config request"))
+		failed(settings.RejectInvalidConfig, false, s.Errorf("expecting config request"))
 		return
 	}
-	c, err := settings.DecodeConfig(r.Payload)
+	c, err = settings.DecodeConfig(r.Payload)
 	if err != nil {
-		failed(s.Errorf("invalid config"))
+		failed(settings.RejectInvalidConfig, false, s.Errorf("invalid config"))
 		return
 	}
 	// 如果客户端的版本与服务端的构建版本不一致，则打印日志
@@ -112,71 +176,186 @@ func (s *Server) handleWebsocket(w http.ResponseWriter, req *http.Request) {
 		}
 		l.Infof("Client version (%s) differs from server version (%s)", v, chshare.BuildVersion)
 	}
-	// 验证远程配置
-	for _, r := range c.Remotes {
-		// 如果设置了user，则确保该user有权限访问
-		if user != nil {
-			addr := r.UserAddr()
-			if !user.HasAccess(addr) {
-				failed(s.Errorf("access to '%s' denied", addr))
-				return
-			}
-		}
-		// 确认服务端是否允许反向隧道
-		if r.Reverse && !s.config.Reverse {
-			l.Debugf("Denied reverse port forwarding request, please enable --reverse")
-			failed(s.Errorf("Reverse port forwaring not enabled on server"))
+	// 检查客户端版本限制
+	if err := s.versions.Check(c.Version); err != nil {
+		l.Infof("Rejected client: %s", err)
+		failed(settings.RejectVersion, false, err)
+		return
+	}
+	// 验证客户端标签
+	if err := settings.ValidateLabels(c.Labels); err != nil {
+		failed(settings.RejectInvalidLabels, false, s.Errorf("%s", err))
+		return
+	}
+	if user != nil {
+		if err := user.CheckLabels(c.Labels); err != nil {
+			failed(settings.RejectInvalidLabels, false, s.Errorf("%s", err))
 			return
 		}
-		// 确认反向隧道是否可用
-		if r.Reverse && !r.CanListen() {
-			failed(s.Errorf("Server cannot listen on %s", r.String()))
+	}
+	if len(c.Labels) > 0 {
+		l.Infof("Client labels: %s", formatLabels(c.Labels))
+	}
+	// 验证远程配置
+	for _, r := range c.Remotes {
+		if rej := s.checkRemote(l, user, r); rej != nil {
+			failed(rej.Code, rej.Retryable, s.Errorf("%s", rej.Message))
 			return
 		}
 	}
-	// 回复config验证通过
-	r.Reply(true, nil)
+	sess := &session{
+		id:         id,
+		user:       user,
+		version:    c.Version,
+		remotes:    c.Remotes,
+		labels:     c.Labels,
+		pool:       c.Pool,
+		poolMember: c.PoolMember,
+		caps:       c.Capabilities.Intersect(settings.SupportedCapabilities),
+		localAddr:  sshConn.LocalAddr().String(),
+		remoteAddr: req.RemoteAddr,
+		start:      time.Now(),
+	}
 	// 给每个ssh连接创建隧道
-	tunnel := tunnel.New(tunnel.Config{
-		Logger:    l,
-		Inbound:   s.config.Reverse,
-		Outbound:  true, // 服务器总是接受出站
-		Socks:     s.config.Socks5,
-		KeepAlive: s.config.KeepAlive,
-		OnConnect: s.config.OnForwardingConnect,
-		OnClose:   s.config.OnForwardingClose,
+	sess.tunnel = tunnel.New(tunnel.Config{
+		Logger:             l,
+		Inbound:            s.config.Reverse,
+		Outbound:           true, // 服务器总是接受出站
+		Socks:              s.config.Socks5,
+		KeepAlive:          s.config.KeepAlive,
+		Remotes:            c.Remotes,
+		KeepAliveTimeout:   s.config.KeepAliveTimeout,
+		KeepAliveMaxMissed: s.config.KeepAliveMaxMissed,
+		MaxChannels:        s.config.MaxChannelsPerSession,
+		ConnRate:           s.config.MaxConnectionsPerSecond,
+		CheckTarget: func(target string) error {
+			return s.checkTarget(sess, target)
+		},
+		RelayService: s.relayService,
+		ResolveAlias: s.resolveAlias,
+		OnBind: func(r *settings.Remote) {
+			e := sess.event(events.RemoteBound)
+			e.Remote = r
+			s.emit(sess, e)
+		},
+		OnUnbind: func(r *settings.Remote) {
+			e := sess.event(events.RemoteUnbound)
+			e.Remote = r
+			s.emit(sess, e)
+		},
+		OnForwardOpen: func(f *tunnel.ForwardInfo) {
+			e := sess.event(events.ForwardOpened)
+			e.Forward = f
+			s.emit(sess, e)
+		},
+		OnForwardClose: func(f *tunnel.ForwardInfo) {
+			e := sess.event(events.ForwardClosed)
+			e.Forward = f
+			s.emit(sess, e)
+		},
 	})
-	// 以第一个配置的localPort为键
-	var localPort string
-	if len(c.Remotes) > 0 {
-		r := c.Remotes[0]
-		localPort = r.LocalPort
-		remotePort := r.RemotePort
-		if s.config.OnConnect != nil {
-			go s.config.OnConnect(localPort, remotePort, tunnel)
-		}
+	// 检查用户的并发会话数量
+	if err := s.active.add(sess, s.config.MaxSessionsPerUser, s.config.MaxPoolConnections); err == errPoolReverse {
+		failed(settings.RejectInvalidConfig, false, s.Errorf("%s", err))
+		return
+	} else if err != nil {
+		failed(settings.RejectLimit, true, s.Errorf("%s", err))
+		return
+	}
+	defer s.active.remove(sess)
+	// 发布服务，不监听端口
+	if err := s.publishServices(sess, c.Remotes); err != nil {
+		failed(settings.RejectPortInUse, true, s.Errorf("%s", err))
+		return
+	}
+	defer s.services.unpublishAll(sess)
+	// 回复config验证通过，旧客户端不理解回复内容，只回复空内容
+	var reply []byte
+	if sess.caps.Has(settings.CapConfigReply) {
+		reply = settings.EncodeConfigReply(settings.ConfigReply{Capabilities: sess.caps})
 	}
+	r.Reply(true, reply)
+	s.emit(sess, sess.event(events.SessionStarted))
 	// bind
 	eg, ctx := errgroup.WithContext(req.Context())
+	sess.tunnel.HandleRequest = func(r *ssh.Request) bool {
+		return s.handleRemoteRequest(ctx, l, sess, r)
+	}
 	eg.Go(func() error {
 		// 移交SSH连接以供隧道使用，并阻塞
-		return tunnel.BindSSH(ctx, sshConn, reqs, chans)
+		return sess.tunnel.BindSSH(ctx, sshConn, reqs, chans)
 	})
 	eg.Go(func() error {
-		serverInbound := c.Remotes.Reversed(true)
+		serverInbound := settings.Remotes{}
+		for _, r := range c.Remotes.Reversed(true) {
+			if r.Service == "" {
+				serverInbound = append(serverInbound, r)
+			}
+		}
 		if len(serverInbound) == 0 {
 			return nil
 		}
 		// 将给定的远程服务转换为代理并阻塞，直到调用者通过取消上下文来关闭代理或出现代理错误后关闭
-		return tunnel.BindRemotes(ctx, serverInbound)
+		return sess.tunnel.BindRemotes(ctx, serverInbound)
 	})
 	err = eg.Wait()
 	if err != nil && !strings.HasSuffix(err.Error(), "EOF") {
 		l.Debugf("Closed connection (%s)", err)
 	} else {
 		l.Debugf("Closed connection")
+		err = nil
 	}
-	if localPort != "" && s.config.OnClose != nil {
-		go s.config.OnClose(localPort)
+	e := sess.event(events.SessionEnded)
+	e.Err = err
+	s.emit(sess, e)
+}
+
+// checkRemote 检查用户是否可以使用给定的远程映射，不可以时返回拒绝原因
+func (s *Server) checkRemote(l *cio.Logger, user *settings.User, r *settings.Remote) *settings.Rejection {
+	// 如果设置了user，则确保该user有权限访问
+	if user != nil {
+		addr := r.UserAddr()
+		if !user.HasAccess(addr) {
+			return &settings.Rejection{Code: settings.RejectAccessDenied, Message: fmt.Sprintf("access to '%s' denied", addr)}
+		}
+	}
+	// 确认别名存在
+	if r.Alias != "" {
+		if _, err := s.resolveAlias(r.Alias); err != nil {
+			return &settings.Rejection{Code: settings.RejectInvalidConfig, Message: err.Error()}
+		}
+	}
+	// 确认服务端是否允许反向隧道
+	if r.Reverse && !s.config.Reverse {
+		l.Debugf("Denied reverse port forwarding request, please enable --reverse")
+		return &settings.Rejection{Code: settings.RejectAccessDenied, Message: "Reverse port forwaring not enabled on server"}
+	}
+	// 确认反向隧道是否可用，发布服务不监听端口
+	if r.Reverse && r.Service == "" && !r.CanListen() {
+		return &settings.Rejection{Code: settings.RejectPortInUse, Message: fmt.Sprintf("Server cannot listen on %s", r.String()), Retryable: true}
+	}
+	return nil
+}
+
+// checkTarget 检查会话是否可以访问通道请求的目标。已通过配置验证的远程映射的目标直接放行，
+// 其他目标(比如 Client.DialContext)需要用户有访问权限
+func (s *Server) checkTarget(sess *session, target string) error {
+	if sess.getRemotes().Reversed(false).Find(target) != nil {
+		return nil
+	}
+	hostPort, _ := settings.L4Proto(target)
+	if sess.user != nil && !sess.user.HasAccess(hostPort) {
+		return fmt.Errorf("access to '%s' denied", hostPort)
+	}
+	return nil
+}
+
+// 按键排序格式化标签
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
 	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
 }
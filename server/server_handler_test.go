@@ -0,0 +1,87 @@
+package chserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	chclient "github.com/yunfeiyang1916/cloud-chisel/client"
+	chshare "github.com/yunfeiyang1916/cloud-chisel/share"
+)
+
+// 以原始websocket握手连接 path，返回响应的状态码
+func testUpgrade(t *testing.T, base, path string, subprotocols []string, header http.Header) int {
+	t.Helper()
+	d := websocket.Dialer{Subprotocols: subprotocols}
+	conn, resp, err := d.Dial("ws"+strings.TrimPrefix(base, "http")+path, header)
+	if conn != nil {
+		conn.Close()
+	}
+	if resp == nil {
+		t.Fatalf("%s: no response: %v", path, err)
+	}
+	return resp.StatusCode
+}
+
+func TestWebSocketPath(t *testing.T) {
+	_, url := testServer(t, &Config{PathPrefix: "/chisel", WebSocketPath: "/tunnel"})
+	proto := []string{chshare.ProtocolVersion}
+	for path, want := range map[string]int{
+		"/chisel/tunnel": http.StatusSwitchingProtocols,
+		"/chisel/wrong":  http.StatusNotFound,
+		"/chisel":        http.StatusNotFound,
+		"/tunnel":        http.StatusNotFound,
+	} {
+		if got := testUpgrade(t, url, path, proto, nil); got != want {
+			t.Errorf("%s: expected %d, got %d", path, want, got)
+		}
+	}
+	if _, err := testClient(t, &chclient.Config{Server: url + "/chisel", WebSocketPath: "/tunnel"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testClient(t, &chclient.Config{Server: url + "/chisel", WebSocketPath: "/wrong"}); err == nil {
+		t.Fatal("expected the wrong websocket path to fail")
+	}
+}
+
+func TestPathPrefix(t *testing.T) {
+	_, url := testServer(t, &Config{PathPrefix: "/chisel/"})
+	for path, want := range map[string]string{
+		"/chisel/health":  "200 OK\n",
+		"/chisel/version": "200 " + chshare.BuildVersion,
+		"/health":         "404 Not found",
+		"/chiselhealth":   "404 Not found",
+	} {
+		resp, err := http.Get(url + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if got := strings.SplitN(resp.Status, " ", 2)[0] + " " + string(b); got != want {
+			t.Errorf("%s: expected %q, got %q", path, want, got)
+		}
+	}
+}
+
+func TestProtocolHeader(t *testing.T) {
+	_, url := testServer(t, &Config{ProtocolHeader: "X-Chisel-Protocol"})
+	header := http.Header{}
+	header.Set("X-Chisel-Protocol", chshare.ProtocolVersion)
+	// 代理去掉 Sec-WebSocket-Protocol 时由请求头协商协议版本
+	if got := testUpgrade(t, url, "/", nil, header); got != http.StatusSwitchingProtocols {
+		t.Fatalf("expected the protocol header to replace the subprotocol, got %d", got)
+	}
+	if got := testUpgrade(t, url, "/", nil, nil); got != http.StatusNotFound {
+		t.Fatalf("expected no protocol to be rejected, got %d", got)
+	}
+	header.Set("X-Chisel-Protocol", "chisel-v0")
+	if got := testUpgrade(t, url, "/", nil, header); got != http.StatusNotFound {
+		t.Fatalf("expected a mismatched protocol to be rejected, got %d", got)
+	}
+	if _, err := testClient(t, &chclient.Config{Server: url, ProtocolHeader: "X-Chisel-Protocol"}); err != nil {
+		t.Fatal(err)
+	}
+}
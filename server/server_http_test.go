@@ -0,0 +1,72 @@
+package chserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+
+	chclient "github.com/yunfeiyang1916/cloud-chisel/client"
+)
+
+// 启动回复 name 和请求路径的HTTP服务，返回其地址
+func testHTTP(t *testing.T, name string) string {
+	t.Helper()
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", name, r.URL.Path)
+	}))
+	t.Cleanup(hs.Close)
+	return hs.URL
+}
+
+// 经由 rt 发送GET请求，检查响应内容
+func testGet(t *testing.T, rt http.RoundTripper, target, want string) {
+	t.Helper()
+	resp, err := (&http.Client{Transport: rt}).Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(b) != want {
+		t.Fatalf("expected 200 %q, got %s %q", want, resp.Status, b)
+	}
+}
+
+func TestClientRoundTripper(t *testing.T) {
+	target := testHTTP(t, "server-side")
+	_, url := testServer(t, &Config{})
+	c, err := testClient(t, &chclient.Config{Server: url})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 由服务端连接目标
+	testGet(t, c.RoundTripper(), target+"/a", "server-side /a")
+	testGet(t, c.RoundTripper(), target+"/b", "server-side /b")
+}
+
+func TestSessionRoundTripper(t *testing.T) {
+	target := testHTTP(t, "client-side")
+	u, _ := url.Parse(target)
+	s, serverURL := testServer(t, &Config{Auth: "u:p"})
+	if _, err := testClient(t, &chclient.Config{
+		Server:    serverURL,
+		Auth:      "u:p",
+		AllowDial: []string{"^" + regexp.QuoteMeta(u.Host) + "$"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// 由客户端连接目标
+	testGet(t, s.SessionRoundTripper("u"), target+"/c", "client-side /c")
+	resp, err := (&http.Client{Transport: s.SessionRoundTripper("nobody")}).Get(target)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("expected unknown session to fail")
+	}
+}
@@ -0,0 +1,102 @@
+package chserver
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	chclient "github.com/yunfeiyang1916/cloud-chisel/client"
+	"github.com/yunfeiyang1916/cloud-chisel/share/settings"
+)
+
+func TestPoolCountsAsOneSession(t *testing.T) {
+	s, url := testServer(t, &Config{Auth: "u:p", MaxSessionsPerUser: 1})
+	c, err := testClient(t, &chclient.Config{Server: url, Auth: "u:p", Connections: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Status().PoolConnected < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 2 pool connections, got %+v", c.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := c.Status(); st.PoolSize != 2 {
+		t.Fatalf("expected pool size 2, got %d", st.PoolSize)
+	}
+	if n := len(s.Sessions()); n != 3 {
+		t.Fatalf("expected 3 sessions, got %d", n)
+	}
+	if sess := s.active.find("u"); sess == nil || sess.poolMember != 0 {
+		t.Fatalf("expected the primary connection, got %+v", sess)
+	}
+	_, err = testClient(t, &chclient.Config{Server: url, Auth: "u:p"})
+	var rej *chclient.RejectedError
+	if !errors.As(err, &rej) || rej.Code != settings.RejectLimit {
+		t.Fatalf("expected session limit rejection, got %v", err)
+	}
+}
+
+func TestSessionIndexPool(t *testing.T) {
+	user := &settings.User{Name: "u"}
+	si := newSessionIndex()
+	primary := &session{id: 1, user: user, pool: "a"}
+	member := &session{id: 2, user: user, pool: "a", poolMember: 1}
+	other := &session{id: 3, user: user, pool: "b"}
+	if err := si.add(primary, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := si.add(member, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := si.add(other, 1, 0); err == nil {
+		t.Fatal("expected another pool to count against the limit")
+	}
+	if got := si.find("u"); got != primary {
+		t.Fatalf("expected the primary session, got %v", got.id)
+	}
+	// 主连接断开后由辅助连接保持计数
+	si.remove(primary)
+	if got := si.find("u"); got != member {
+		t.Fatalf("expected the pool member, got %v", got)
+	}
+	if err := si.add(other, 1, 0); err == nil {
+		t.Fatal("expected the pool to still count against the limit")
+	}
+	si.remove(member)
+	if err := si.add(other, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionIndexPoolLimits(t *testing.T) {
+	user := &settings.User{Name: "u"}
+	reverse, err := settings.DecodeRemote("R:8000:localhost:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	si := newSessionIndex()
+	primary := &session{id: 1, user: user, pool: "a", remotes: settings.Remotes{reverse}}
+	if err := si.add(primary, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	// 辅助连接不能携带反向映射，同一连接池也不能有第二个主连接
+	if err := si.add(&session{id: 2, user: user, pool: "a", poolMember: 1, remotes: settings.Remotes{reverse}}, 1, 2); err != errPoolReverse {
+		t.Fatalf("expected errPoolReverse, got %v", err)
+	}
+	if err := si.add(&session{id: 3, user: user, pool: "a"}, 1, 2); err == nil {
+		t.Fatal("expected a second primary to be rejected")
+	}
+	if err := si.add(&session{id: 4, user: user, pool: "a", poolMember: 1}, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := si.add(&session{id: 5, user: user, pool: "a", poolMember: 2}, 1, 2); err == nil {
+		t.Fatal("expected the pool limit to be enforced")
+	}
+	// 主连接断开后可以重新加入
+	si.remove(primary)
+	if err := si.add(&session{id: 6, user: user, pool: "a"}, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+}
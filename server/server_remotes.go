@@ -0,0 +1,98 @@
+package chserver
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/yunfeiyang1916/cloud-chisel/share/cio"
+	"github.com/yunfeiyang1916/cloud-chisel/share/settings"
+	"golang.org/x/crypto/ssh"
+)
+
+// handleRemoteRequest 处理客户端在会话中增删远程映射的请求，不是这类请求时返回false
+func (s *Server) handleRemoteRequest(ctx context.Context, l *cio.Logger, sess *session, req *ssh.Request) bool {
+	if req.Type != "remote-add" && req.Type != "remote-remove" {
+		return false
+	}
+	reject := func(rej *settings.Rejection) {
+		l.Debugf("Rejected %s: %s", req.Type, rej.Message)
+		req.Reply(false, settings.EncodeRejection(*rej))
+	}
+	if !sess.caps.Has(settings.CapRemotes) {
+		reject(&settings.Rejection{Code: settings.RejectInvalidConfig, Message: "remotes capability not negotiated"})
+		return true
+	}
+	r, err := settings.DecodeRemote(string(req.Payload))
+	if err != nil {
+		reject(&settings.Rejection{Code: settings.RejectInvalidConfig, Message: err.Error()})
+		return true
+	}
+	var rej *settings.Rejection
+	if req.Type == "remote-add" {
+		rej = s.addRemote(ctx, l, sess, r)
+	} else {
+		rej = s.removeRemote(l, sess, r)
+	}
+	if rej != nil {
+		reject(rej)
+		return true
+	}
+	req.Reply(true, nil)
+	return true
+}
+
+// 验证并添加远程映射，反向映射在服务端开始监听，发布服务的映射登记服务
+func (s *Server) addRemote(ctx context.Context, l *cio.Logger, sess *session, r *settings.Remote) *settings.Rejection {
+	sess.remotesMut.Lock()
+	defer sess.remotesMut.Unlock()
+	for _, existing := range sess.remotes {
+		if existing.Encode() == r.Encode() {
+			return &settings.Rejection{Code: settings.RejectInvalidConfig, Message: fmt.Sprintf("remote %s already exists", r)}
+		}
+	}
+	if r.Reverse && sess.pool != "" && sess.poolMember > 0 {
+		return &settings.Rejection{Code: settings.RejectInvalidConfig, Message: errPoolReverse.Error()}
+	}
+	if rej := s.checkRemote(l, sess.user, r); rej != nil {
+		return rej
+	}
+	if r.Reverse && r.Service != "" {
+		if err := s.services.publish(sess, r); err != nil {
+			return &settings.Rejection{Code: settings.RejectPortInUse, Message: err.Error(), Retryable: true}
+		}
+	} else if r.Reverse {
+		if err := sess.tunnel.BindRemote(ctx, r); err != nil {
+			return &settings.Rejection{Code: settings.RejectPortInUse, Message: err.Error(), Retryable: true}
+		}
+	}
+	remotes := make(settings.Remotes, 0, len(sess.remotes)+1)
+	remotes = append(append(remotes, sess.remotes...), r)
+	sess.remotes = remotes
+	sess.tunnel.SetRemotes(remotes)
+	l.Infof("Added remote %s", r)
+	return nil
+}
+
+// 移除远程映射，反向映射停止监听
+func (s *Server) removeRemote(l *cio.Logger, sess *session, r *settings.Remote) *settings.Rejection {
+	sess.remotesMut.Lock()
+	defer sess.remotesMut.Unlock()
+	remotes := make(settings.Remotes, 0, len(sess.remotes))
+	for _, existing := range sess.remotes {
+		if existing.Encode() != r.Encode() {
+			remotes = append(remotes, existing)
+		}
+	}
+	if len(remotes) == len(sess.remotes) {
+		return &settings.Rejection{Code: settings.RejectInvalidConfig, Message: fmt.Sprintf("remote %s not found", r)}
+	}
+	if r.Reverse && r.Service != "" {
+		s.services.unpublish(sess, r.Service)
+	} else if r.Reverse {
+		sess.tunnel.UnbindRemote(r)
+	}
+	sess.remotes = remotes
+	sess.tunnel.SetRemotes(remotes)
+	l.Infof("Removed remote %s", r)
+	return nil
+}
@@ -0,0 +1,97 @@
+package chserver
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	chclient "github.com/yunfeiyang1916/cloud-chisel/client"
+)
+
+// 返回一个空闲的本地端口
+func testPort(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return port
+}
+
+func TestRemoveRemoteClosesListener(t *testing.T) {
+	_, url := testServer(t, &Config{Reverse: true})
+	remote := "R:127.0.0.1:" + testPort(t)
+	c, err := chclient.NewClient(&chclient.Config{Server: url, MaxRetryCount: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Info = false
+	t.Cleanup(func() { c.Close() })
+	l, err := c.Listen(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testClientStart(t, c); err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		accepted <- err
+	}()
+	if err := c.RemoveRemote(remote); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-accepted:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("expected net.ErrClosed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept still blocked after RemoveRemote")
+	}
+}
+
+func TestAddReverseRemote(t *testing.T) {
+	_, url := testServer(t, &Config{Reverse: true})
+	c, err := testClient(t, &chclient.Config{Server: url})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := "127.0.0.1:" + testPort(t)
+	if err := c.AddRemote("R:" + addr + ":" + testEcho(t)); err != nil {
+		t.Fatal(err)
+	}
+	// 服务端开始监听后的第一个连接就应被客户端接受
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testRoundTrip(t, conn)
+}
+
+func TestAddRemoteRejected(t *testing.T) {
+	_, url := testServer(t, &Config{})
+	c, err := testClient(t, &chclient.Config{Server: url})
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := "R:127.0.0.1:" + testPort(t) + ":" + testEcho(t)
+	// 被拒绝的映射需要从本地移除，再次添加时仍由服务端拒绝
+	for i := 0; i < 2; i++ {
+		var denied *chclient.AccessDenied
+		if err := c.AddRemote(remote); !errors.As(err, &denied) {
+			t.Fatalf("expected AccessDenied, got %v", err)
+		}
+	}
+	for _, r := range c.ControlStatus().Remotes {
+		if strings.HasPrefix(r.Remote, "R:") {
+			t.Fatalf("rejected remote %s still configured", r.Remote)
+		}
+	}
+}
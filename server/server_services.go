@@ -0,0 +1,91 @@
+package chserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/yunfeiyang1916/cloud-chisel/share/settings"
+)
+
+// serviceIndex 客户端发布的服务，每个服务名称同时只能由一个会话发布
+type serviceIndex struct {
+	sync.RWMutex
+	inner map[string]*publishedService
+}
+
+// publishedService 已发布的服务及其发布方
+type publishedService struct {
+	sess *session
+	// 发布方连接的目标地址
+	target string
+}
+
+func newServiceIndex() *serviceIndex {
+	return &serviceIndex{inner: map[string]*publishedService{}}
+}
+
+// publish 发布服务，名称已被其他会话发布时返回错误
+func (si *serviceIndex) publish(sess *session, r *settings.Remote) error {
+	si.Lock()
+	defer si.Unlock()
+	if p, ok := si.inner[r.Service]; ok && p.sess != sess {
+		return fmt.Errorf("service '%s' already published by session#%s", r.Service, p.sess.sid())
+	}
+	si.inner[r.Service] = &publishedService{sess: sess, target: r.Remote()}
+	return nil
+}
+
+// unpublish 取消会话发布的服务
+func (si *serviceIndex) unpublish(sess *session, name string) {
+	si.Lock()
+	defer si.Unlock()
+	if p, ok := si.inner[name]; ok && p.sess == sess {
+		delete(si.inner, name)
+	}
+}
+
+// unpublishAll 取消会话发布的全部服务
+func (si *serviceIndex) unpublishAll(sess *session) {
+	si.Lock()
+	defer si.Unlock()
+	for name, p := range si.inner {
+		if p.sess == sess {
+			delete(si.inner, name)
+		}
+	}
+}
+
+func (si *serviceIndex) get(name string) *publishedService {
+	si.RLock()
+	defer si.RUnlock()
+	return si.inner[name]
+}
+
+// 发布会话的全部服务，任何一个失败时取消已发布的服务
+func (s *Server) publishServices(sess *session, remotes settings.Remotes) error {
+	for _, r := range remotes {
+		if !r.Reverse || r.Service == "" {
+			continue
+		}
+		if err := s.services.publish(sess, r); err != nil {
+			s.services.unpublishAll(sess)
+			return err
+		}
+	}
+	return nil
+}
+
+// relayService 经由发布服务的会话连接服务的目标，由发布方客户端建立连接，
+// 最多等待 SSH_TIMEOUT(30秒)
+func (s *Server) relayService(name string) (net.Conn, error) {
+	p := s.services.get(name)
+	if p == nil {
+		return nil, fmt.Errorf("service '%s' not published", name)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), settings.EnvDuration("SSH_TIMEOUT", 30*time.Second))
+	defer cancel()
+	return p.sess.tunnel.DialContext(ctx, "tcp", p.target)
+}
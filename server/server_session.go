@@ -0,0 +1,298 @@
+package chserver
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/yunfeiyang1916/cloud-chisel/share/audit"
+	"github.com/yunfeiyang1916/cloud-chisel/share/events"
+	"github.com/yunfeiyang1916/cloud-chisel/share/settings"
+	"github.com/yunfeiyang1916/cloud-chisel/share/tunnel"
+)
+
+// session 已通过配置验证的客户端会话
+type session struct {
+	id int32
+	// 会话所属用户，未启用认证时为nil
+	user *settings.User
+	// 客户端的版本号
+	version string
+	// 客户端请求的远程映射，运行中可以通过 remote-add 和 remote-remove 请求增删
+	remotesMut sync.RWMutex
+	remotes    settings.Remotes
+	// 客户端的标签
+	labels map[string]string
+	// 客户端连接池的标识和连接序号，同一连接池的会话只计为一个用户会话
+	pool       string
+	poolMember int
+	// 双方都支持的能力
+	caps settings.Capabilities
+	// 本端和客户端的地址
+	localAddr, remoteAddr string
+	// 会话的隧道
+	tunnel *tunnel.Tunnel
+	// 会话开始的时间
+	start time.Time
+}
+
+// 当前的远程映射
+func (s *session) getRemotes() settings.Remotes {
+	s.remotesMut.RLock()
+	defer s.remotesMut.RUnlock()
+	return s.remotes
+}
+
+// 会话编号
+func (s *session) sid() string {
+	return strconv.Itoa(int(s.id))
+}
+
+// 用户名，未启用认证时为空
+func (s *session) userName() string {
+	if s.user == nil {
+		return ""
+	}
+	return s.user.Name
+}
+
+// 连接池的默认会话数量上限，防止通过相同的连接池标识绕过每个用户的会话数量限制
+const defaultMaxPoolConnections = 64
+
+// 连接池的辅助连接携带了反向映射
+var errPoolReverse = errors.New("pool connections cannot carry reverse remotes")
+
+// sessionIndex 活跃会话的索引
+type sessionIndex struct {
+	sync.RWMutex
+	inner map[int32]*session
+	// 每个用户的并发会话数量，同一连接池的会话只计一次
+	perUser map[string]int
+	// 每个连接池的会话，键为用户名和连接池标识
+	pools map[string]*sessionPool
+}
+
+// sessionPool 同一连接池中的会话数量，以及是否已有主连接。
+// 只有主连接可以携带反向映射，因此每个连接池最多一个主连接
+type sessionPool struct {
+	members int
+	primary bool
+}
+
+func newSessionIndex() *sessionIndex {
+	return &sessionIndex{
+		inner:   map[int32]*session{},
+		perUser: map[string]int{},
+		pools:   map[string]*sessionPool{},
+	}
+}
+
+// 会话所属连接池的键，不属于连接池时为空
+func (s *session) poolKey() string {
+	if s.pool == "" {
+		return ""
+	}
+	return s.userName() + "/" + s.pool
+}
+
+// add 添加会话，maxSessions大于0时限制每个用户的并发会话数量，
+// maxPool限制每个连接池的会话数量，不大于0时使用默认值。
+// 连接池的辅助连接只能携带正向映射，否则返回 errPoolReverse
+func (si *sessionIndex) add(sess *session, maxSessions, maxPool int) error {
+	if maxPool <= 0 {
+		maxPool = defaultMaxPoolConnections
+	}
+	key := sess.poolKey()
+	if key != "" && sess.poolMember > 0 && len(sess.getRemotes().Reversed(true)) > 0 {
+		return errPoolReverse
+	}
+	si.Lock()
+	defer si.Unlock()
+	name := sess.userName()
+	if p := si.pools[key]; p != nil {
+		// 已计数的连接池中的其他连接
+		if p.members >= maxPool {
+			return fmt.Errorf("too many connections in pool for user '%s' (max %d)", name, maxPool)
+		}
+		if sess.poolMember == 0 && p.primary {
+			return fmt.Errorf("pool of user '%s' already has a primary connection", name)
+		}
+		si.inner[sess.id] = sess
+		p.members++
+		p.primary = p.primary || sess.poolMember == 0
+		return nil
+	}
+	if maxSessions > 0 && sess.user != nil && si.perUser[name] >= maxSessions {
+		return fmt.Errorf("too many sessions for user '%s' (max %d)", name, maxSessions)
+	}
+	si.inner[sess.id] = sess
+	si.perUser[name]++
+	if key != "" {
+		si.pools[key] = &sessionPool{members: 1, primary: sess.poolMember == 0}
+	}
+	return nil
+}
+
+// remove 移除会话，连接池的最后一个会话移除时才减少用户的会话数量
+func (si *sessionIndex) remove(sess *session) {
+	si.Lock()
+	defer si.Unlock()
+	if _, ok := si.inner[sess.id]; !ok {
+		return
+	}
+	delete(si.inner, sess.id)
+	if key := sess.poolKey(); key != "" {
+		p := si.pools[key]
+		if sess.poolMember == 0 {
+			p.primary = false
+		}
+		if p.members--; p.members > 0 {
+			return
+		}
+		delete(si.pools, key)
+	}
+	name := sess.userName()
+	if si.perUser[name]--; si.perUser[name] <= 0 {
+		delete(si.perUser, name)
+	}
+}
+
+// SessionInfo 活跃会话的信息
+type SessionInfo struct {
+	ID      string
+	User    string
+	Version string
+	Remotes settings.Remotes
+	Labels  map[string]string
+	// 双方都支持的能力
+	Capabilities settings.Capabilities
+	// 客户端地址
+	RemoteAddr string
+	// 会话开始的时间
+	Started time.Time
+	// 客户端连接池的标识和连接序号，0为主连接
+	Pool       string
+	PoolMember int
+	// 保活ping的往返时间统计
+	RTT tunnel.RTTStats
+}
+
+func (s *session) info() SessionInfo {
+	return SessionInfo{
+		ID:           s.sid(),
+		User:         s.userName(),
+		Version:      s.version,
+		Remotes:      s.getRemotes(),
+		Labels:       s.labels,
+		Capabilities: s.caps,
+		RemoteAddr:   s.remoteAddr,
+		Started:      s.start,
+		Pool:         s.pool,
+		PoolMember:   s.poolMember,
+		RTT:          s.tunnel.RTT(),
+	}
+}
+
+// list 按会话编号排序返回全部会话
+func (si *sessionIndex) list() []*session {
+	si.RLock()
+	l := make([]*session, 0, len(si.inner))
+	for _, sess := range si.inner {
+		l = append(l, sess)
+	}
+	si.RUnlock()
+	sort.Slice(l, func(i, j int) bool { return l[i].id < l[j].id })
+	return l
+}
+
+// find 按会话编号或用户名查找会话，同一用户有多个会话时返回最新的会话，
+// 优先选择连接池的主连接而不是辅助连接
+func (si *sessionIndex) find(key string) *session {
+	var found *session
+	for _, sess := range si.list() {
+		if sess.sid() == key {
+			return sess
+		}
+		if sess.userName() == key && key != "" {
+			if found == nil || found.poolMember > 0 || sess.poolMember == 0 {
+				found = sess
+			}
+		}
+	}
+	return found
+}
+
+// Sessions 返回全部活跃会话的信息
+func (s *Server) Sessions() []SessionInfo {
+	list := s.active.list()
+	infos := make([]SessionInfo, len(list))
+	for i, sess := range list {
+		infos[i] = sess.info()
+	}
+	return infos
+}
+
+// 构造会话事件
+func (s *session) event(typ events.Type) *events.Event {
+	return &events.Event{
+		Type:       typ,
+		Time:       time.Now(),
+		Session:    s.sid(),
+		User:       s.userName(),
+		Remotes:    s.getRemotes(),
+		Labels:     s.labels,
+		LocalAddr:  s.localAddr,
+		RemoteAddr: s.remoteAddr,
+		Tunnel:     s.tunnel,
+	}
+}
+
+// emit 产生事件，写入审计日志并通知 Config.OnEvent 和 webhook，不属于会话的事件sess为nil
+func (s *Server) emit(sess *session, e *events.Event) {
+	f, err := e.Forward, e.Err
+	switch e.Type {
+	case events.SessionStarted:
+		s.auditRecord(audit.Event{
+			Time:    e.Time,
+			Type:    audit.SessionStart,
+			Session: e.Session,
+			User:    e.User,
+			Source:  e.RemoteAddr,
+		})
+	case events.SessionEnded:
+		reason := "closed"
+		if err != nil {
+			reason = err.Error()
+		}
+		s.auditRecord(audit.Event{
+			Time:     e.Time,
+			Type:     audit.SessionEnd,
+			Session:  e.Session,
+			User:     e.User,
+			Source:   e.RemoteAddr,
+			Duration: time.Since(sess.start).Milliseconds(),
+			Reason:   reason,
+		})
+	case events.ForwardClosed:
+		s.auditRecord(audit.Event{
+			Time:     e.Time,
+			Type:     audit.Forward,
+			Session:  e.Session,
+			User:     e.User,
+			Source:   f.Source,
+			Target:   f.Target,
+			Proto:    f.Proto,
+			Sent:     f.Sent,
+			Received: f.Received,
+			Duration: f.Duration.Milliseconds(),
+			Reason:   f.Reason(),
+		})
+	}
+	if s.config.OnEvent != nil {
+		s.config.OnEvent(e)
+	}
+	s.webhooks.notify(e)
+}
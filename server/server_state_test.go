@@ -0,0 +1,72 @@
+package chserver
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	chclient "github.com/yunfeiyang1916/cloud-chisel/client"
+)
+
+func TestStateChanges(t *testing.T) {
+	s, err := NewServer(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Info = false
+	hs := httptest.NewServer(s.Handler())
+	defer hs.Close()
+	c, err := chclient.NewClient(&chclient.Config{
+		Server:           hs.URL,
+		MaxRetryCount:    1,
+		MinRetryInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Info = false
+	changes := c.StateChanges()
+	if err := c.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var got []chclient.State
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case st, ok := <-changes:
+			if !ok {
+				want := []chclient.State{chclient.StateConnecting, chclient.StateConnected, chclient.StateDisconnected, chclient.StateGaveUp}
+				if !subsequence(want, got) {
+					t.Fatalf("expected states %v in order, got %v", want, got)
+				}
+				if got[len(got)-1] != chclient.StateGaveUp {
+					t.Fatalf("expected the last state to be gave up, got %v", got)
+				}
+				return
+			}
+			got = append(got, st.State)
+			if st.State == chclient.StateConnected {
+				// 服务端不再接受连接并断开会话，客户端重试一次后放弃
+				hs.Listener.Close()
+				for _, sess := range s.active.list() {
+					sess.tunnel.Close(context.Background())
+				}
+			}
+		case <-timeout:
+			t.Fatalf("state channel not closed, got %v", got)
+		}
+	}
+}
+
+// want 是否按顺序出现在 got 中
+func subsequence(want, got []chclient.State) bool {
+	i := 0
+	for _, s := range got {
+		if i < len(want) && s == want[i] {
+			i++
+		}
+	}
+	return i == len(want)
+}
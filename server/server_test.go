@@ -0,0 +1,152 @@
+package chserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	chclient "github.com/yunfeiyang1916/cloud-chisel/client"
+	"github.com/yunfeiyang1916/cloud-chisel/share/cnet"
+	"github.com/yunfeiyang1916/cloud-chisel/share/settings"
+)
+
+// 启动进程内的服务端，返回服务端及其地址
+func testServer(t *testing.T, c *Config) (*Server, string) {
+	t.Helper()
+	s, err := NewServer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Info = false
+	hs := httptest.NewServer(s.Handler())
+	t.Cleanup(hs.Close)
+	return s, hs.URL
+}
+
+// 创建并启动客户端，不重试，返回等待连接的结果
+func testClient(t *testing.T, c *chclient.Config) (*chclient.Client, error) {
+	t.Helper()
+	c.MaxRetryCount = 0
+	client, err := chclient.NewClient(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Info = false
+	t.Cleanup(func() { client.Close() })
+	return testClientStart(t, client)
+}
+
+// 启动客户端并等待连接
+func testClientStart(t *testing.T, client *chclient.Client) (*chclient.Client, error) {
+	t.Helper()
+	if err := client.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return client, client.WaitReady(ctx)
+}
+
+// 启动回显服务，返回其地址
+func testEcho(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// 经由 conn 发送数据并检查回显
+func testRoundTrip(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+		t.Fatalf("expected echo, got %q %v", b, err)
+	}
+}
+
+func TestMaxSessionsPerUser(t *testing.T) {
+	_, url := testServer(t, &Config{Auth: "u:p", MaxSessionsPerUser: 1})
+	if _, err := testClient(t, &chclient.Config{Server: url, Auth: "u:p"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := testClient(t, &chclient.Config{Server: url, Auth: "u:p"})
+	var rej *chclient.RejectedError
+	if !errors.As(err, &rej) || rej.Code != settings.RejectLimit {
+		t.Fatalf("expected session limit rejection, got %v", err)
+	}
+}
+
+func TestMaxChannelsPerSession(t *testing.T) {
+	echo := testEcho(t)
+	_, url := testServer(t, &Config{MaxChannelsPerSession: 1})
+	c, err := testClient(t, &chclient.Config{Server: url})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := c.DialContext(context.Background(), "tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = c.DialContext(context.Background(), "tcp", echo)
+	if err == nil || !strings.Contains(err.Error(), "too many channels") {
+		t.Fatalf("expected channel limit rejection, got %v", err)
+	}
+}
+
+func TestMaxConnectionsPerSecond(t *testing.T) {
+	echo := testEcho(t)
+	_, url := testServer(t, &Config{MaxConnectionsPerSecond: 1})
+	c, err := testClient(t, &chclient.Config{Server: url})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := c.DialContext(context.Background(), "tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	_, err = c.DialContext(context.Background(), "tcp", echo)
+	if err == nil || !strings.Contains(err.Error(), "rate limit exceeded") {
+		t.Fatalf("expected rate limit rejection, got %v", err)
+	}
+}
+
+func TestCloseWithoutStart(t *testing.T) {
+	s, _ := testServer(t, &Config{
+		AuditLog: filepath.Join(t.TempDir(), "audit.log"),
+		Webhooks: []string{"http://127.0.0.1:1/hook"},
+	})
+	// 只通过 Handler 使用时 Close 仍然停止webhook并关闭审计日志
+	if err := s.Close(); err != nil {
+		t.Fatalf("expected Close to succeed without Start, got %v", err)
+	}
+	if err := s.Wait(); !errors.Is(err, cnet.ErrNotStarted) {
+		t.Fatalf("expected Wait to report not started, got %v", err)
+	}
+}
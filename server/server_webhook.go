@@ -0,0 +1,177 @@
+package chserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jpillora/backoff"
+	"github.com/yunfeiyang1916/cloud-chisel/share/cio"
+	"github.com/yunfeiyang1916/cloud-chisel/share/events"
+	"github.com/yunfeiyang1916/cloud-chisel/share/settings"
+)
+
+// webhook 签名和签名时间的请求头
+const (
+	webhookSignatureHeader = "X-Chisel-Signature"
+	webhookTimestampHeader = "X-Chisel-Timestamp"
+)
+
+// webhookPayload 发送给webhook的JSON
+type webhookPayload struct {
+	Type       events.Type       `json:"type"`
+	Time       time.Time         `json:"time"`
+	Session    string            `json:"session,omitempty"`
+	User       string            `json:"user,omitempty"`
+	RemoteAddr string            `json:"remote_addr,omitempty"`
+	Remotes    []string          `json:"remotes,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Remote     string            `json:"remote,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// webhooks 将隧道生命周期事件投递到配置的URL，每个URL一个有序队列
+type webhooks struct {
+	*cio.Logger
+	secret  []byte
+	client  *http.Client
+	retries int
+	queues  map[string]chan []byte
+	// 取消后停止投递，包括正在等待重试的事件
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newWebhooks(logger *cio.Logger, urls []string, secret string) *webhooks {
+	if len(urls) == 0 {
+		return nil
+	}
+	w := &webhooks{
+		Logger:  logger.Fork("webhook"),
+		secret:  []byte(secret),
+		client:  &http.Client{Timeout: settings.EnvDuration("WEBHOOK_TIMEOUT", 10*time.Second)},
+		retries: settings.EnvInt("WEBHOOK_RETRIES", 5),
+		queues:  map[string]chan []byte{},
+	}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	for _, u := range urls {
+		q := make(chan []byte, settings.EnvInt("WEBHOOK_QUEUE", 256))
+		w.queues[u] = q
+		go w.run(u, q)
+	}
+	return w
+}
+
+// notify 将事件加入每个URL的队列，队列已满时丢弃
+func (w *webhooks) notify(e *events.Event) {
+	if w == nil {
+		return
+	}
+	switch e.Type {
+	case events.SessionStarted, events.SessionEnded,
+		events.RemoteBound, events.RemoteUnbound, events.AuthFailed:
+	default:
+		return
+	}
+	p := webhookPayload{
+		Type:       e.Type,
+		Time:       e.Time,
+		Session:    e.Session,
+		User:       e.User,
+		RemoteAddr: e.RemoteAddr,
+		Remotes:    e.Remotes.Encode(),
+		Labels:     e.Labels,
+	}
+	if e.Remote != nil {
+		p.Remote = e.Remote.Encode()
+	}
+	if e.Err != nil {
+		p.Error = e.Err.Error()
+	}
+	b, _ := json.Marshal(p)
+	for u, q := range w.queues {
+		select {
+		case q <- b:
+		default:
+			w.Infof("Queue full, dropped %s event for %s", e.Type, u)
+		}
+	}
+}
+
+// close 停止投递，队列中未投递的事件被丢弃
+func (w *webhooks) close() {
+	if w == nil {
+		return
+	}
+	w.cancel()
+}
+
+func (w *webhooks) run(url string, queue <-chan []byte) {
+	for {
+		var body []byte
+		select {
+		case body = <-queue:
+		case <-w.ctx.Done():
+			return
+		}
+		b := &backoff.Backoff{Min: time.Second, Max: time.Minute}
+		for {
+			err := w.post(url, body)
+			if err == nil {
+				break
+			}
+			if w.ctx.Err() != nil {
+				return
+			}
+			if int(b.Attempt()) >= w.retries {
+				w.Infof("Giving up delivery to %s: %s", url, err)
+				break
+			}
+			d := b.Duration()
+			w.Debugf("Delivery to %s failed: %s, retrying in %s", url, err, d)
+			select {
+			case <-time.After(d):
+			case <-w.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// 签名时间戳和请求内容，每次投递(包括重试)使用新的时间戳
+func (w *webhooks) sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, w.secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *webhooks) post(url string, body []byte) error {
+	req, err := http.NewRequestWithContext(w.ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(w.secret) > 0 {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(webhookTimestampHeader, ts)
+		req.Header.Set(webhookSignatureHeader, w.sign(ts, body))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
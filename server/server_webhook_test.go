@@ -0,0 +1,69 @@
+package chserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yunfeiyang1916/cloud-chisel/share/cio"
+	"github.com/yunfeiyang1916/cloud-chisel/share/events"
+)
+
+func TestWebhookSignature(t *testing.T) {
+	type delivery struct {
+		ts, sig string
+		body    []byte
+	}
+	got := make(chan delivery, 1)
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		got <- delivery{r.Header.Get(webhookTimestampHeader), r.Header.Get(webhookSignatureHeader), b}
+	}))
+	defer hs.Close()
+	w := newWebhooks(cio.NewLogger("test"), []string{hs.URL}, "secret")
+	defer w.close()
+	w.notify(&events.Event{Type: events.SessionStarted, Time: time.Now(), Session: "1"})
+	var d delivery
+	select {
+	case d = <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not delivered")
+	}
+	if d.ts == "" {
+		t.Fatal("missing timestamp header")
+	}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(d.ts + "."))
+	mac.Write(d.body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); d.sig != want {
+		t.Errorf("expected signature %s, got %s", want, d.sig)
+	}
+}
+
+func TestWebhookCloseStopsRetries(t *testing.T) {
+	var requests int32
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer hs.Close()
+	w := newWebhooks(cio.NewLogger("test"), []string{hs.URL}, "")
+	w.notify(&events.Event{Type: events.SessionStarted, Time: time.Now()})
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&requests) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	w.close()
+	n := atomic.LoadInt32(&requests)
+	// 第一次重试在1秒后
+	time.Sleep(1500 * time.Millisecond)
+	if m := atomic.LoadInt32(&requests); m != n {
+		t.Errorf("expected no retries after close, got %d more", m-n)
+	}
+}
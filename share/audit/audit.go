@@ -0,0 +1,133 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// 审计事件类型
+const (
+	LoginSuccess = "login_success"
+	LoginFailure = "login_failure"
+	SessionStart = "session_start"
+	SessionEnd   = "session_end"
+	Forward      = "forward"
+)
+
+// Event 审计事件，每个事件序列化为一行JSON
+type Event struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Session string    `json:"session,omitempty"`
+	User    string    `json:"user,omitempty"`
+	// 来源地址
+	Source string `json:"source,omitempty"`
+	// 目标地址
+	Target string `json:"target,omitempty"`
+	Proto  string `json:"proto,omitempty"`
+	// 从来源发往目标的字节数
+	Sent int64 `json:"sent,omitempty"`
+	// 从目标返回来源的字节数
+	Received int64 `json:"received,omitempty"`
+	// 持续时长，单位毫秒
+	Duration int64 `json:"duration_ms,omitempty"`
+	// 关闭或失败的原因
+	Reason string `json:"reason,omitempty"`
+}
+
+// Log 按大小轮转的审计日志文件，nil表示未启用审计
+type Log struct {
+	mut  sync.Mutex
+	path string
+	// 单个文件的最大字节数
+	maxSize int64
+	// 保留的历史文件数量
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// New 打开审计日志文件，maxSize为单个文件的最大字节数(0表示不轮转)，
+// maxBackups为保留的历史文件数量，历史文件依次命名为 <path>.1, <path>.2 ...
+func New(path string, maxSize int64, maxBackups int) (*Log, error) {
+	l := &Log{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to open audit log: %s", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// Record 写入一个事件，未设置时间时使用当前时间
+func (l *Log) Record(e Event) error {
+	if l == nil {
+		return nil
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(b)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(b)
+	l.size += int64(n)
+	return err
+}
+
+// 轮转日志文件: <path>.N-1 -> <path>.N ... <path> -> <path>.1
+func (l *Log) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	if l.maxBackups <= 0 {
+		os.Remove(l.path)
+	} else {
+		for i := l.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+		}
+		if err := os.Rename(l.path, l.path+".1"); err != nil {
+			return err
+		}
+	}
+	return l.open()
+}
+
+// Close 关闭审计日志文件
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	return l.file.Close()
+}
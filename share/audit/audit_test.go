@@ -0,0 +1,110 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// 读取日志文件中的事件
+func readEvents(t *testing.T, path string) []Event {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var events []Event
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var e Event
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	const maxSize = 256
+	l, err := New(path, maxSize, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := l.Record(Event{Type: Forward, Session: fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// 当前文件和两个历史文件，更早的被删除
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > maxSize {
+			t.Errorf("%s: size %d exceeds %d", p, info.Size(), maxSize)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 backups, got %v", err)
+	}
+	// 最新的事件在当前文件的末尾，历史文件依次更早
+	current := readEvents(t, path)
+	if last := current[len(current)-1].Session; last != "19" {
+		t.Errorf("expected last event 19, got %s", last)
+	}
+	older := readEvents(t, path+".2")
+	newer := readEvents(t, path+".1")
+	o, _ := strconv.Atoi(older[len(older)-1].Session)
+	n, _ := strconv.Atoi(newer[0].Session)
+	if o >= n {
+		t.Errorf("expected %s.2 to be older than %s.1", path, path)
+	}
+}
+
+func TestRotateNoBackups(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	l, err := New(path, 128, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := l.Record(Event{Type: Forward}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Close()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the current file, got %d files", len(entries))
+	}
+}
+
+func TestAppendExisting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	for i := 0; i < 2; i++ {
+		l, err := New(path, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Record(Event{Type: SessionStart})
+		l.Close()
+	}
+	if n := len(readEvents(t, path)); n != 2 {
+		t.Errorf("expected 2 events after reopening, got %d", n)
+	}
+}
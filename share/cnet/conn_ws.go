@@ -1,15 +1,22 @@
 package cnet
 
 import (
+	"errors"
 	"github.com/gorilla/websocket"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
+// ErrDeadPeer 对端连续多次没有回复ping，连接已被关闭
+var ErrDeadPeer = errors.New("peer stopped responding to pings")
+
 // websocket 连接
 type wsConn struct {
 	*websocket.Conn
 	buff []byte
+	// 是否因对端没有回复ping而关闭
+	dead int32
 }
 
 // NewWebSocketConn 将 net.Conn 转成wsConn
@@ -32,6 +39,9 @@ func (c *wsConn) Read(dst []byte) (int, error) {
 	} else if _, msg, err := c.Conn.ReadMessage(); err == nil {
 		src = msg
 	} else {
+		if atomic.LoadInt32(&c.dead) == 1 {
+			return 0, ErrDeadPeer
+		}
 		return 0, err
 	}
 	//copy src->dest
@@ -66,3 +76,34 @@ func (c *wsConn) SetDeadline(t time.Time) error {
 	}
 	return c.Conn.SetWriteDeadline(t)
 }
+
+// PingWebSocket 在后台每隔 interval 发送一次websocket ping帧，直到连接关闭。
+// 对端会自动回复pong，连续 maxMissed 个ping没有收到pong时关闭连接，maxMissed 为0时不检查。
+// conn 必须由 NewWebSocketConn 创建，且需在开始读取前调用
+func PingWebSocket(conn net.Conn, interval time.Duration, maxMissed int) {
+	c, ok := conn.(*wsConn)
+	if !ok || interval <= 0 {
+		return
+	}
+	// 最后一个ping也需要等待一个间隔
+	timeout := time.Duration(maxMissed+1) * interval
+	lastPong := time.Now().UnixNano()
+	c.Conn.SetPongHandler(func(string) error {
+		atomic.StoreInt64(&lastPong, time.Now().UnixNano())
+		return nil
+	})
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for range t.C {
+			if maxMissed > 0 && time.Since(time.Unix(0, atomic.LoadInt64(&lastPong))) > timeout {
+				atomic.StoreInt32(&c.dead, 1)
+				c.Conn.Close()
+				return
+			}
+			if err := c.Conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(interval)); err != nil {
+				return
+			}
+		}
+	}()
+}
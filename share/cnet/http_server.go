@@ -56,11 +56,14 @@ func (h *HTTPServer) GoServer(ctx context.Context, l net.Listener, handler http.
 	return nil
 }
 
+// ErrNotStarted 服务器尚未启动时 Close 和 Wait 返回的错误
+var ErrNotStarted = errors.New("not started yet")
+
 func (h *HTTPServer) Close() error {
 	h.waiterMux.Lock()
 	defer h.waiterMux.Unlock()
 	if h.waiter == nil {
-		return errors.New("not started yet")
+		return ErrNotStarted
 	}
 	return h.Server.Close()
 }
@@ -70,7 +73,7 @@ func (h *HTTPServer) Wait() error {
 	unset := h.waiter == nil
 	h.waiterMux.Unlock()
 	if unset {
-		return errors.New("not started yet")
+		return ErrNotStarted
 	}
 	h.waiterMux.Lock()
 	wait := h.waiter.Wait
@@ -0,0 +1,21 @@
+package cnet
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// NewTransport 创建使用给定拨号函数的 http.Transport，连接池和保活的设置与 http.DefaultTransport 一致，
+// 不使用环境变量中的HTTP代理
+func NewTransport(dial func(ctx context.Context, network, addr string) (net.Conn, error)) *http.Transport {
+	return &http.Transport{
+		DialContext:           dial,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
@@ -0,0 +1,57 @@
+package events
+
+import (
+	"time"
+
+	"github.com/yunfeiyang1916/cloud-chisel/share/settings"
+	"github.com/yunfeiyang1916/cloud-chisel/share/tunnel"
+)
+
+// Type 事件类型
+type Type string
+
+const (
+	// SessionStarted 会话通过配置验证，隧道可用
+	SessionStarted Type = "session_started"
+	// SessionEnded 会话断开
+	SessionEnded Type = "session_ended"
+	// ForwardOpened 打开了一个转发连接
+	ForwardOpened Type = "forward_opened"
+	// ForwardClosed 转发连接已关闭，携带字节数和持续时长
+	ForwardClosed Type = "forward_closed"
+	// RemoteBound 开始监听一个远程映射的本地端口
+	RemoteBound Type = "remote_bound"
+	// RemoteUnbound 停止监听一个远程映射的本地端口
+	RemoteUnbound Type = "remote_unbound"
+	// AuthFailed 用户认证失败，不属于任何会话
+	AuthFailed Type = "auth_failed"
+)
+
+// Event 隧道生命周期事件，chserver 和 chclient 共用
+type Event struct {
+	Type Type
+	Time time.Time
+	// 会话编号
+	Session string
+	// 会话的用户名，未启用认证时为空
+	User string
+	// 会话的全部远程映射
+	Remotes settings.Remotes
+	// 客户端的标签
+	Labels map[string]string
+	// 会话的本端地址
+	LocalAddr string
+	// 会话的对端地址
+	RemoteAddr string
+	// 会话的隧道
+	Tunnel *tunnel.Tunnel
+	// 绑定或解绑的远程映射，仅绑定事件有值
+	Remote *settings.Remote
+	// 转发连接的信息，仅转发事件有值
+	Forward *tunnel.ForwardInfo
+	// 会话结束的错误，正常结束时为nil
+	Err error
+}
+
+// Handler 事件处理函数，在产生事件的协程中同步调用，应尽快返回
+type Handler func(e *Event)
@@ -0,0 +1,46 @@
+package settings
+
+// 可选的协议能力，只有双方都支持时才启用对应的行为
+const (
+	// CapConfigReply 理解配置请求的结构化回复 ConfigReply
+	CapConfigReply = "config-reply"
+	// CapRejectCodes 理解配置请求被拒绝时的结构化回复 Rejection
+	CapRejectCodes = "reject-codes"
+	// CapDial 客户端接受服务端通过 Server.DialSession 打开的连接，仅在客户端配置了允许列表时声明
+	CapDial = "dial"
+	// CapRemotes 支持在会话中通过 remote-add 和 remote-remove 请求增删远程映射，
+	// 请求内容为 Remote.Encode()，拒绝时回复 Rejection
+	CapRemotes = "remotes"
+)
+
+// SupportedCapabilities 本版本支持的全部能力
+var SupportedCapabilities = Capabilities{
+	CapConfigReply,
+	CapRejectCodes,
+	CapDial,
+	CapRemotes,
+}
+
+// Capabilities 能力列表
+type Capabilities []string
+
+// Has 是否包含给定的能力
+func (cs Capabilities) Has(name string) bool {
+	for _, c := range cs {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Intersect 返回双方都支持的能力
+func (cs Capabilities) Intersect(other Capabilities) Capabilities {
+	both := Capabilities{}
+	for _, c := range cs {
+		if other.Has(c) {
+			both = append(both, c)
+		}
+	}
+	return both
+}
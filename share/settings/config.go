@@ -2,7 +2,9 @@ package settings
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"regexp"
 )
 
 // Config 本地与远程服务的映射集合及协议版本号
@@ -11,6 +13,21 @@ type Config struct {
 	Version string
 	// 本地与远程服务的映射集合
 	Remotes
+	// 客户端的标签，比如主机名、设备编号、环境等
+	Labels map[string]string
+	// 客户端支持的能力
+	Capabilities Capabilities
+	// 客户端连接池的标识，同一客户端的并行连接相同，为空表示没有连接池
+	Pool string
+	// 连接在连接池中的序号，0为主连接
+	PoolMember int
+}
+
+// ConfigReply 服务端对配置请求的成功回复，仅当客户端声明了 CapConfigReply 时发送，
+// 否则按照旧协议回复空内容
+type ConfigReply struct {
+	// 双方都支持的能力
+	Capabilities Capabilities
 }
 
 // DecodeConfig 解码配置
@@ -29,3 +46,42 @@ func EncodeConfig(c Config) []byte {
 	b, _ := json.Marshal(c)
 	return b
 }
+
+// DecodeConfigReply 解码配置回复
+func DecodeConfigReply(b []byte) (*ConfigReply, error) {
+	c := &ConfigReply{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("Invalid JSON config reply")
+	}
+	return c, nil
+}
+
+// EncodeConfigReply 编码配置回复
+func EncodeConfigReply(c ConfigReply) []byte {
+	b, _ := json.Marshal(c)
+	return b
+}
+
+// 标签的数量和长度限制
+const (
+	maxLabels        = 64
+	maxLabelValueLen = 256
+)
+
+var labelKey = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._/-]{0,62}$`)
+
+// ValidateLabels 校验标签的格式
+func ValidateLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return fmt.Errorf("Too many labels (max %d)", maxLabels)
+	}
+	for k, v := range labels {
+		if !labelKey.MatchString(k) {
+			return fmt.Errorf("Invalid label key '%s'", k)
+		}
+		if len(v) > maxLabelValueLen {
+			return errors.New("Label value too long: " + k)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package settings
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// 配置请求被拒绝的原因
+const (
+	RejectInvalidConfig = "invalid_config"
+	RejectAccessDenied  = "access_denied"
+	RejectPortInUse     = "port_in_use"
+	RejectVersion       = "version_rejected"
+	RejectLimit         = "limit_exceeded"
+	RejectInvalidLabels = "invalid_labels"
+)
+
+// Rejection 服务端拒绝配置请求时的结构化回复，仅当客户端声明了 CapRejectCodes 时发送，
+// 否则按照旧协议只回复错误信息
+type Rejection struct {
+	Code    string
+	Message string
+	// 客户端稍后重试是否可能成功
+	Retryable bool
+	// 可选的建议重试等待秒数，仅在 Retryable 时有效
+	RetryAfter int `json:",omitempty"`
+}
+
+func (r *Rejection) Error() string {
+	return fmt.Sprintf("%s (%s)", r.Message, r.Code)
+}
+
+// DecodeRejection 解码拒绝回复
+func DecodeRejection(b []byte) (*Rejection, error) {
+	r := &Rejection{}
+	if err := json.Unmarshal(b, r); err != nil {
+		return nil, fmt.Errorf("Invalid JSON rejection")
+	}
+	return r, nil
+}
+
+// EncodeRejection 编码拒绝回复
+func EncodeRejection(r Rejection) []byte {
+	b, _ := json.Marshal(r)
+	return b
+}
@@ -31,6 +31,14 @@ import (
 //   1.1.1.1:53/udp
 //     local  127.0.0.1:53/udp
 //     remote 1.1.1.1:53/udp
+//   R:svc:db:5432
+//     publish service db, target 127.0.0.1:5432
+//   5432:svc:db
+//     local  0.0.0.0:5432
+//     remote service db (published by another client)
+//   5432:@db
+//     local  0.0.0.0:5432
+//     remote alias db (resolved by the server)
 
 // Remote 本地与远程服务的映射
 type Remote struct {
@@ -51,6 +59,11 @@ type Remote struct {
 	Reverse bool
 	// 使用标准输入输出
 	Stdio bool
+	// 服务名称。反向映射表示发布服务，经由服务端转发到 RemoteHost:RemotePort；
+	// 正向映射表示使用其他客户端发布的服务
+	Service string
+	// 服务端定义的目标别名，由服务端解析成实际的地址
+	Alias string
 }
 
 // 反向代理前缀
@@ -64,6 +77,12 @@ func DecodeRemote(s string) (*Remote, error) {
 		reverse = true
 	}
 	parts := regexp.MustCompile(`(\[[^\[\]]+\]|[^\[\]:]+):?`).FindAllStringSubmatch(s, -1)
+	if r, ok, err := decodeService(parts, reverse); ok {
+		return r, err
+	}
+	if r, ok, err := decodeAlias(parts, reverse); ok {
+		return r, err
+	}
 	if len(parts) <= 0 || len(parts) >= 5 {
 		return nil, errors.New("Invalid remote")
 	}
@@ -149,6 +168,102 @@ func DecodeRemote(s string) (*Remote, error) {
 	return r, nil
 }
 
+// 服务映射的前缀
+const svcPrefix = "svc:"
+
+var serviceName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// 解码服务映射，不是服务映射时ok为false。
+// 服务名称不能是端口号，以便与主机名为 svc 的普通映射区分
+func decodeService(parts [][]string, reverse bool) (r *Remote, ok bool, err error) {
+	i := 0
+	if !reverse {
+		i = len(parts) - 2
+	}
+	if i < 0 || i+1 >= len(parts) || parts[i][1] != "svc" {
+		return nil, false, nil
+	}
+	name := parts[i+1][1]
+	if isPort(name) {
+		return nil, false, nil
+	}
+	if !serviceName.MatchString(name) {
+		return nil, true, errors.New("Invalid service name")
+	}
+	r = &Remote{Reverse: reverse, Service: name, LocalProto: "tcp", RemoteProto: "tcp"}
+	if reverse {
+		// R:svc:<name>:[host:]port
+		target := parts[2:]
+		switch len(target) {
+		case 1:
+			r.RemoteHost = "127.0.0.1"
+			r.RemotePort = target[0][1]
+		case 2:
+			r.RemoteHost = target[0][1]
+			r.RemotePort = target[1][1]
+		default:
+			return nil, true, errors.New("Missing service target")
+		}
+		if !isPort(r.RemotePort) || !isHost(r.RemoteHost) {
+			return nil, true, errors.New("Invalid service target")
+		}
+		return r, true, nil
+	}
+	// [host:]port:svc:<name> 或 stdio:svc:<name>
+	if err := decodeLocal(r, parts[:i]); err != nil {
+		return nil, true, err
+	}
+	return r, true, nil
+}
+
+// 别名映射的前缀
+const aliasPrefix = "@"
+
+// 解码服务端别名的映射 [host:]port:@<name>[/udp]，不是别名映射时ok为false
+func decodeAlias(parts [][]string, reverse bool) (r *Remote, ok bool, err error) {
+	last := parts[len(parts)-1][1]
+	if !strings.HasPrefix(last, aliasPrefix) {
+		return nil, false, nil
+	}
+	if reverse {
+		return nil, true, errors.New("aliases cannot be reversed")
+	}
+	name, proto := L4Proto(strings.TrimPrefix(last, aliasPrefix))
+	if !serviceName.MatchString(name) {
+		return nil, true, errors.New("Invalid alias name")
+	}
+	if proto == "" {
+		proto = "tcp"
+	}
+	r = &Remote{Alias: name, LocalProto: proto, RemoteProto: proto}
+	if err := decodeLocal(r, parts[:len(parts)-1]); err != nil {
+		return nil, true, err
+	}
+	return r, true, nil
+}
+
+// 解码服务和别名映射的本地部分 [host:]port 或 stdio
+func decodeLocal(r *Remote, local [][]string) error {
+	switch len(local) {
+	case 1:
+		if local[0][1] == "stdio" {
+			r.Stdio = true
+			return nil
+		}
+		r.LocalHost = "0.0.0.0"
+		r.LocalPort = local[0][1]
+	case 2:
+		r.LocalHost = local[0][1]
+		r.LocalPort = local[1][1]
+	default:
+		return errors.New("Missing ports")
+	}
+	if !isPort(r.LocalPort) || !isHost(r.LocalHost) {
+		return errors.New("Invalid local address")
+	}
+	return nil
+}
+
 func isPort(s string) bool {
 	n, err := strconv.Atoi(s)
 	if err != nil {
@@ -195,7 +310,7 @@ func (r Remote) String() string {
 
 // Encode 编码
 func (r Remote) Encode() string {
-	if r.LocalPort == "" {
+	if r.LocalPort == "" && r.Service == "" {
 		r.LocalPort = r.RemotePort
 	}
 	local := r.Local()
@@ -214,6 +329,9 @@ func (r Remote) Local() string {
 	if r.Stdio {
 		return "stdio"
 	}
+	if r.Service != "" && r.Reverse {
+		return svcPrefix + r.Service
+	}
 	if r.LocalHost == "" {
 		r.LocalHost = "0.0.0.0"
 	}
@@ -225,14 +343,38 @@ func (r Remote) Remote() string {
 	if r.Socks {
 		return "socks"
 	}
+	if r.Service != "" && !r.Reverse {
+		return svcPrefix + r.Service
+	}
+	if r.Alias != "" {
+		return aliasPrefix + r.Alias
+	}
 	if r.RemoteHost == "" {
 		r.RemoteHost = "127.0.0.1"
 	}
 	return r.RemoteHost + ":" + r.RemotePort
 }
 
-// UserAddr is checked when checking if a user has access to a given remote
+// Target 打开通道时请求的目标，udp映射带 /udp 后缀
+func (r Remote) Target() string {
+	if r.RemoteProto == "udp" {
+		return r.Remote() + "/udp"
+	}
+	return r.Remote()
+}
+
+// UserAddr is checked when checking if a user has access to a given remote.
+// 发布服务为 R:svc:<name>，使用服务为 svc:<name>，别名为 @<name>
 func (r Remote) UserAddr() string {
+	if r.Alias != "" {
+		return aliasPrefix + r.Alias
+	}
+	if r.Service != "" {
+		if r.Reverse {
+			return revPrefix + svcPrefix + r.Service
+		}
+		return svcPrefix + r.Service
+	}
 	if r.Reverse {
 		return "R:" + r.LocalHost + ":" + r.LocalPort
 	}
@@ -266,6 +408,26 @@ func (r Remote) CanListen() bool {
 	return false
 }
 
+// ServiceName 返回通道目标中的服务名称，目标不是服务时ok为false
+func ServiceName(target string) (name string, ok bool) {
+	name = strings.TrimPrefix(target, svcPrefix)
+	if name == target || isPort(name) {
+		return "", false
+	}
+	return name, true
+}
+
+// AliasName 返回通道目标中的别名，目标不是别名时ok为false
+func AliasName(target string) (name string, ok bool) {
+	name = strings.TrimPrefix(target, aliasPrefix)
+	return name, name != target
+}
+
+// ValidAliasName 检查别名是否合法
+func ValidAliasName(name string) bool {
+	return serviceName.MatchString(name)
+}
+
 // Remotes 本地与远程服务的映射集合
 type Remotes []*Remote
 
@@ -281,6 +443,16 @@ func (rs Remotes) Reversed(reverse bool) Remotes {
 	return subset
 }
 
+// Find 返回通道目标为 target 的远程映射，没有时返回nil
+func (rs Remotes) Find(target string) *Remote {
+	for _, r := range rs {
+		if r.Target() == target {
+			return r
+		}
+	}
+	return nil
+}
+
 // Encode 编码
 func (rs Remotes) Encode() []string {
 	s := make([]string, len(rs))
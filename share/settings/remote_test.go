@@ -0,0 +1,132 @@
+package settings
+
+import "testing"
+
+// 期望的解码结果，Err 不为空时只检查错误
+type remoteCase struct {
+	Input                   string
+	Err                     string
+	Service, Alias          string
+	Reverse, Stdio          bool
+	Local, Remote, User     string
+	LocalProto, RemoteProto string
+}
+
+func testRemotes(t *testing.T, cases []remoteCase) {
+	t.Helper()
+	for _, c := range cases {
+		r, err := DecodeRemote(c.Input)
+		if c.Err != "" {
+			if err == nil || err.Error() != c.Err {
+				t.Errorf("%s: expected error %q, got %v", c.Input, c.Err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", c.Input, err)
+			continue
+		}
+		got := remoteCase{
+			Input:       c.Input,
+			Service:     r.Service,
+			Alias:       r.Alias,
+			Reverse:     r.Reverse,
+			Stdio:       r.Stdio,
+			Local:       r.Local(),
+			Remote:      r.Remote(),
+			User:        r.UserAddr(),
+			LocalProto:  r.LocalProto,
+			RemoteProto: r.RemoteProto,
+		}
+		if c.LocalProto == "" {
+			c.LocalProto, c.RemoteProto = "tcp", "tcp"
+		}
+		if got != c {
+			t.Errorf("%s:\nexpected %+v\ngot      %+v", c.Input, c, got)
+		}
+		// 编码后能解码成相同的映射
+		r2, err := DecodeRemote(r.Encode())
+		if err != nil || r2.Encode() != r.Encode() {
+			t.Errorf("%s: encode round trip %q failed: %v", c.Input, r.Encode(), err)
+		}
+	}
+}
+
+func TestDecodeService(t *testing.T) {
+	testRemotes(t, []remoteCase{
+		{Input: "R:svc:db:5432", Service: "db", Reverse: true, Local: "svc:db", Remote: "127.0.0.1:5432", User: "R:svc:db"},
+		{Input: "R:svc:db:10.0.0.5:5432", Service: "db", Reverse: true, Local: "svc:db", Remote: "10.0.0.5:5432", User: "R:svc:db"},
+		{Input: "5432:svc:db", Service: "db", Local: "0.0.0.0:5432", Remote: "svc:db", User: "svc:db"},
+		{Input: "127.0.0.1:5432:svc:db", Service: "db", Local: "127.0.0.1:5432", Remote: "svc:db", User: "svc:db"},
+		{Input: "stdio:svc:db", Service: "db", Stdio: true, Local: "stdio", Remote: "svc:db", User: "svc:db"},
+		// 服务名称是端口号时是到主机 svc 的普通映射
+		{Input: "3000:svc:8080", Local: "0.0.0.0:3000", Remote: "svc:8080", User: "svc:8080"},
+		{Input: "R:svc:db", Err: "Missing service target"},
+		{Input: "svc:db", Err: "Missing ports"},
+		{Input: "R:svc:bad name:1", Err: "Invalid service name"},
+		{Input: "R:svc:db/udp:5432", Err: "Invalid service name"},
+	})
+}
+
+func TestServiceName(t *testing.T) {
+	for target, want := range map[string]string{
+		"svc:db":    "db",
+		"svc:a.b-c": "a.b-c",
+		"svc:8080":  "",
+		"db:5432":   "",
+	} {
+		name, ok := ServiceName(target)
+		if ok != (want != "") || name != want {
+			t.Errorf("%s: expected %q, got %q (%v)", target, want, name, ok)
+		}
+	}
+}
+
+func TestDecodeAlias(t *testing.T) {
+	testRemotes(t, []remoteCase{
+		{Input: "5432:@db", Alias: "db", Local: "0.0.0.0:5432", Remote: "@db", User: "@db"},
+		{Input: "127.0.0.1:5432:@db", Alias: "db", Local: "127.0.0.1:5432", Remote: "@db", User: "@db"},
+		{Input: "5353:@dns/udp", Alias: "dns", Local: "0.0.0.0:5353", Remote: "@dns", User: "@dns", LocalProto: "udp", RemoteProto: "udp"},
+		{Input: "R:5432:@db", Err: "aliases cannot be reversed"},
+		{Input: "@db", Err: "Missing ports"},
+	})
+}
+
+func TestAliasName(t *testing.T) {
+	if name, ok := AliasName("@db"); !ok || name != "db" {
+		t.Errorf("expected alias db, got %q (%v)", name, ok)
+	}
+	if _, ok := AliasName("db:5432"); ok {
+		t.Error("expected db:5432 not to be an alias")
+	}
+	for name, ok := range map[string]bool{"db": true, "db-1.internal": true, "": false, "-db": false, "a b": false} {
+		if ValidAliasName(name) != ok {
+			t.Errorf("alias name %q: expected valid=%v", name, ok)
+		}
+	}
+}
+
+func TestRemotesFind(t *testing.T) {
+	var rs Remotes
+	for _, s := range []string{"3000:10.0.0.1:80", "5353:10.0.0.2:53/udp", "R:8080:localhost:80"} {
+		r, err := DecodeRemote(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs = append(rs, r)
+	}
+	for target, want := range map[string]string{
+		"10.0.0.1:80":     "0.0.0.0:3000:10.0.0.1:80",
+		"10.0.0.2:53/udp": "0.0.0.0:5353:10.0.0.2:53/udp",
+		"10.0.0.2:53":     "",
+		"localhost:80":    "R:0.0.0.0:8080:localhost:80",
+	} {
+		got := ""
+		if r := rs.Find(target); r != nil {
+			got = r.Encode()
+		}
+		if got != want {
+			t.Errorf("%s: expected %q, got %q", target, want, got)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package settings
 
 import (
+	"fmt"
 	"regexp"
 	"strings"
 )
@@ -19,6 +20,8 @@ type User struct {
 	Name  string
 	Pass  string
 	Addrs []*regexp.Regexp
+	// 允许客户端携带的标签，键为标签名，值为标签值的正则。nil表示不限制
+	Labels map[string]*regexp.Regexp
 }
 
 func (u *User) HasAccess(addr string) bool {
@@ -31,3 +34,20 @@ func (u *User) HasAccess(addr string) bool {
 	}
 	return m
 }
+
+// CheckLabels 检查客户端的标签是否符合用户的标签策略
+func (u *User) CheckLabels(labels map[string]string) error {
+	if u.Labels == nil {
+		return nil
+	}
+	for k, v := range labels {
+		re, ok := u.Labels[k]
+		if !ok {
+			return fmt.Errorf("label '%s' not allowed", k)
+		}
+		if !re.MatchString(v) {
+			return fmt.Errorf("label '%s' value '%s' not allowed", k, v)
+		}
+	}
+	return nil
+}
@@ -127,18 +127,28 @@ func (u *UserIndex) loadUserIndex() error {
 	if err != nil {
 		return fmt.Errorf("Failed to read auth file: %s, error: %s", u.configFile, err)
 	}
-	var raw map[string][]string
+	var raw map[string]json.RawMessage
 	if err := json.Unmarshal(b, &raw); err != nil {
 		return errors.New("Invalid JSON: " + err.Error())
 	}
 	users := []*User{}
-	for auth, remotes := range raw {
+	for auth, v := range raw {
 		user := &User{}
 		user.Name, user.Pass = ParseAuth(auth)
 		if user.Name == "" {
 			return errors.New("Invalid user:pass string")
 		}
-		for _, r := range remotes {
+		// 值可以是地址正则数组，或者 {"addrs": [...], "labels": {"<key>": "<value-regex>"}}
+		var policy struct {
+			Addrs  []string          `json:"addrs"`
+			Labels map[string]string `json:"labels"`
+		}
+		if err := json.Unmarshal(v, &policy.Addrs); err != nil {
+			if err := json.Unmarshal(v, &policy); err != nil {
+				return errors.New("Invalid user policy: " + user.Name)
+			}
+		}
+		for _, r := range policy.Addrs {
 			if r == "" || r == "*" {
 				user.Addrs = append(user.Addrs, UserAllowAll)
 			} else {
@@ -149,6 +159,19 @@ func (u *UserIndex) loadUserIndex() error {
 				user.Addrs = append(user.Addrs, re)
 			}
 		}
+		if policy.Labels != nil {
+			user.Labels = map[string]*regexp.Regexp{}
+			for k, r := range policy.Labels {
+				re := UserAllowAll
+				if r != "" && r != "*" {
+					var err error
+					if re, err = regexp.Compile(r); err != nil {
+						return errors.New("Invalid label regex")
+					}
+				}
+				user.Labels[k] = re
+			}
+		}
 		users = append(users, user)
 	}
 	//swap
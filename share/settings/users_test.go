@@ -0,0 +1,125 @@
+package settings
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yunfeiyang1916/cloud-chisel/share/cio"
+)
+
+// 从内容为 content 的用户配置文件加载用户
+func testUserIndex(t *testing.T, content string) (*UserIndex, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "users.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	u := NewUserIndex(cio.NewLogger("test"))
+	u.configFile = path
+	return u, u.loadUserIndex()
+}
+
+func TestLoadUsers(t *testing.T) {
+	u, err := testUserIndex(t, `{
+		"foo:bar": ["^0.0.0.0:3000$"],
+		"ping:pong": {"addrs": ["^0.0.0.0:[45]000$", ""], "labels": {"env": "^(prod|staging)$", "host": "*"}},
+		"any:one": {"addrs": ["*"]}
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Len() != 3 {
+		t.Fatalf("expected 3 users, got %d", u.Len())
+	}
+	foo, _ := u.Get("foo")
+	if foo.Pass != "bar" || !foo.HasAccess("0.0.0.0:3000") || foo.HasAccess("0.0.0.0:4000") {
+		t.Fatalf("unexpected user foo: %+v", foo)
+	}
+	if foo.Labels != nil {
+		t.Fatal("expected no label policy for the array form")
+	}
+	ping, _ := u.Get("ping")
+	if ping.Pass != "pong" || len(ping.Addrs) != 2 || ping.Addrs[1] != UserAllowAll {
+		t.Fatalf("unexpected user ping: %+v", ping)
+	}
+	if ping.Labels["host"] != UserAllowAll || ping.Labels["env"].String() != "^(prod|staging)$" {
+		t.Fatalf("unexpected label policy: %v", ping.Labels)
+	}
+	one, _ := u.Get("any")
+	if !one.HasAccess("10.0.0.1:22") || one.Labels != nil {
+		t.Fatalf("unexpected user any: %+v", one)
+	}
+}
+
+func TestLoadUsersInvalid(t *testing.T) {
+	for content, want := range map[string]string{
+		`[]`:                                    "Invalid JSON",
+		`{":bar": []}`:                          "Invalid user:pass string",
+		`{"foo:bar": "0.0.0.0:3000"}`:           "Invalid user policy",
+		`{"foo:bar": ["("]}`:                    "Invalid address regex",
+		`{"foo:bar": {"addrs": ["("]}}`:         "Invalid address regex",
+		`{"foo:bar": {"labels": {"env": "("}}}`: "Invalid label regex",
+		`{"foo:bar": {"labels": ["env"]}}`:      "Invalid user policy",
+	} {
+		_, err := testUserIndex(t, content)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected error %q, got %v", content, want, err)
+		}
+	}
+}
+
+func TestCheckLabels(t *testing.T) {
+	u, err := testUserIndex(t, `{"foo:bar": {"addrs": [""], "labels": {"env": "^(prod|staging)$", "host": ""}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foo, _ := u.Get("foo")
+	for _, c := range []struct {
+		labels map[string]string
+		err    string
+	}{
+		{nil, ""},
+		{map[string]string{"env": "prod"}, ""},
+		{map[string]string{"env": "staging", "host": "anything"}, ""},
+		{map[string]string{"env": "dev"}, "label 'env' value 'dev' not allowed"},
+		{map[string]string{"env": "preprod"}, "label 'env' value 'preprod' not allowed"},
+		{map[string]string{"team": "a"}, "label 'team' not allowed"},
+	} {
+		err := foo.CheckLabels(c.labels)
+		if (err == nil) != (c.err == "") || (err != nil && err.Error() != c.err) {
+			t.Errorf("%v: expected %q, got %v", c.labels, c.err, err)
+		}
+	}
+	// 没有标签策略时不限制
+	if err := (&User{}).CheckLabels(map[string]string{"team": "a"}); err != nil {
+		t.Errorf("expected no label policy to allow any label, got %v", err)
+	}
+}
+
+func TestValidateLabels(t *testing.T) {
+	tooMany := map[string]string{}
+	for i := 0; i <= maxLabels; i++ {
+		tooMany[fmt.Sprintf("k%d", i)] = "v"
+	}
+	for _, c := range []struct {
+		labels map[string]string
+		err    bool
+	}{
+		{nil, false},
+		{map[string]string{"env": "prod", "app.kubernetes.io/name": "web", "Host-1": ""}, false},
+		{map[string]string{"": "x"}, true},
+		{map[string]string{"-env": "x"}, true},
+		{map[string]string{"env name": "x"}, true},
+		{map[string]string{strings.Repeat("k", 64): "x"}, true},
+		{map[string]string{"env": strings.Repeat("v", maxLabelValueLen)}, false},
+		{map[string]string{"env": strings.Repeat("v", maxLabelValueLen+1)}, true},
+		{tooMany, true},
+	} {
+		if err := ValidateLabels(c.labels); (err != nil) != c.err {
+			t.Errorf("%d labels: expected error=%v, got %v", len(c.labels), c.err, err)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package settings
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var semver = regexp.MustCompile(`^v?(\d+)\.(\d+)\.(\d+)(?:-([0-9A-Za-z.-]+))?(?:\+[0-9A-Za-z.-]+)?$`)
+
+// Version 语义化版本号 <major>.<minor>.<patch>[-<pre-release>][+<build>]
+type Version struct {
+	Major, Minor, Patch int
+	// 预发布标识，比如 rc.1，有预发布标识的版本低于对应的正式版本
+	Pre string
+}
+
+// ParseVersion 解析语义化版本号，允许 v 前缀
+func ParseVersion(s string) (Version, error) {
+	m := semver.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return Version{}, fmt.Errorf("Invalid version '%s'", s)
+	}
+	v := Version{Pre: m[4]}
+	v.Major, _ = strconv.Atoi(m[1])
+	v.Minor, _ = strconv.Atoi(m[2])
+	v.Patch, _ = strconv.Atoi(m[3])
+	return v, nil
+}
+
+// Compare 比较版本号，小于、等于、大于o时分别返回-1、0、1
+func (v Version) Compare(o Version) int {
+	for _, d := range []int{v.Major - o.Major, v.Minor - o.Minor, v.Patch - o.Patch} {
+		if d < 0 {
+			return -1
+		} else if d > 0 {
+			return 1
+		}
+	}
+	switch {
+	case v.Pre == o.Pre:
+		return 0
+	case v.Pre == "":
+		return 1
+	case o.Pre == "":
+		return -1
+	}
+	return comparePre(v.Pre, o.Pre)
+}
+
+// 按 semver §11 比较预发布标识：以点分隔逐段比较，数字段按数值比较且低于非数字段，
+// 其他段按ASCII顺序比较，前缀相同时段数少的较低
+func comparePre(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, xerr := strconv.ParseUint(as[i], 10, 64)
+		y, yerr := strconv.ParseUint(bs[i], 10, 64)
+		switch {
+		case xerr == nil && yerr == nil:
+			if x != y {
+				if x < y {
+					return -1
+				}
+				return 1
+			}
+		case xerr == nil:
+			return -1
+		case yerr == nil:
+			return 1
+		case as[i] != bs[i]:
+			if as[i] < bs[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(as) < len(bs):
+		return -1
+	case len(as) > len(bs):
+		return 1
+	}
+	return 0
+}
+
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Pre != "" {
+		s += "-" + v.Pre
+	}
+	return s
+}
+
+// VersionPolicy 客户端版本的限制策略，零值表示不限制
+type VersionPolicy struct {
+	// 允许的最低版本，nil表示不限制
+	Min *Version
+	// 允许的最高版本，nil表示不限制
+	Max *Version
+	// 允许的版本列表，非空时只允许列出的版本
+	Allowed []Version
+}
+
+// NewVersionPolicy 解析版本限制，参数为空表示不限制对应项
+func NewVersionPolicy(min, max string, allowed []string) (*VersionPolicy, error) {
+	p := &VersionPolicy{}
+	if min != "" {
+		v, err := ParseVersion(min)
+		if err != nil {
+			return nil, err
+		}
+		p.Min = &v
+	}
+	if max != "" {
+		v, err := ParseVersion(max)
+		if err != nil {
+			return nil, err
+		}
+		p.Max = &v
+	}
+	for _, a := range allowed {
+		v, err := ParseVersion(a)
+		if err != nil {
+			return nil, err
+		}
+		p.Allowed = append(p.Allowed, v)
+	}
+	return p, nil
+}
+
+// Enabled 是否设置了任何限制
+func (p *VersionPolicy) Enabled() bool {
+	return p != nil && (p.Min != nil || p.Max != nil || len(p.Allowed) > 0)
+}
+
+// Check 检查客户端版本，不符合时返回可读的升级提示
+func (p *VersionPolicy) Check(version string) error {
+	if !p.Enabled() {
+		return nil
+	}
+	v, err := ParseVersion(version)
+	if err != nil {
+		if version == "" {
+			version = "<unknown>"
+		}
+		return fmt.Errorf("Client version %s is not supported, please upgrade to %s", version, p.want())
+	}
+	if len(p.Allowed) > 0 {
+		for _, a := range p.Allowed {
+			if v.Compare(a) == 0 {
+				return nil
+			}
+		}
+		return fmt.Errorf("Client version %s is not allowed, please install %s", v, p.want())
+	}
+	if p.Min != nil && v.Compare(*p.Min) < 0 {
+		return fmt.Errorf("Client version %s is too old, please upgrade to %s", v, p.want())
+	}
+	if p.Max != nil && v.Compare(*p.Max) > 0 {
+		return fmt.Errorf("Client version %s is too new, please install %s", v, p.want())
+	}
+	return nil
+}
+
+// 可读的版本要求
+func (p *VersionPolicy) want() string {
+	if len(p.Allowed) > 0 {
+		s := make([]string, len(p.Allowed))
+		for i, a := range p.Allowed {
+			s[i] = a.String()
+		}
+		return "one of " + strings.Join(s, ", ")
+	}
+	switch {
+	case p.Min != nil && p.Max != nil:
+		return fmt.Sprintf("a version between %s and %s", p.Min, p.Max)
+	case p.Min != nil:
+		return fmt.Sprintf("version %s or later", p.Min)
+	}
+	return fmt.Sprintf("version %s or earlier", p.Max)
+}
@@ -0,0 +1,71 @@
+package settings
+
+import "testing"
+
+func TestVersionCompare(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.3", "1.2.3", 0},
+		{"v1.2.3", "1.2.3", 0},
+		{"1.2.3+build.1", "1.2.3", 0},
+		{"1.2.3", "1.10.0", -1},
+		{"2.0.0", "1.99.99", 1},
+		{"1.0.0-rc.1", "1.0.0", -1},
+		{"1.0.0-rc.2", "1.0.0-rc.1", 1},
+		{"1.0.0-rc.10", "1.0.0-rc.2", 1},
+		{"1.0.0-rc.2", "1.0.0-rc.10", -1},
+		{"1.0.0-alpha", "1.0.0-alpha.1", -1},
+		{"1.0.0-alpha.1", "1.0.0-alpha", 1},
+		{"1.0.0-alpha.1", "1.0.0-alpha.beta", -1},
+		{"1.0.0-alpha.beta", "1.0.0-beta", -1},
+		{"1.0.0-beta.11", "1.0.0-rc.1", -1},
+		{"1.0.0-rc.1", "1.0.0-rc.1+build.5", 0},
+	} {
+		a, err := ParseVersion(c.a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ParseVersion(c.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := a.Compare(b); got != c.want {
+			t.Errorf("compare %s %s: expected %d, got %d", c.a, c.b, c.want, got)
+		}
+	}
+}
+
+func TestVersionPolicy(t *testing.T) {
+	p, err := NewVersionPolicy("1.7.0", "2.0.0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for v, ok := range map[string]bool{
+		"1.7.0":     true,
+		"1.9.3":     true,
+		"2.0.0":     true,
+		"1.6.9":     false,
+		"2.0.1":     false,
+		"0.0.0-src": false,
+		"":          false,
+	} {
+		if err := p.Check(v); (err == nil) != ok {
+			t.Errorf("version %q: expected allowed=%v, got %v", v, ok, err)
+		}
+	}
+	p, err = NewVersionPolicy("", "", []string{"1.8.1", "1.9.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Check("1.9.0"); err != nil {
+		t.Error(err)
+	}
+	if err := p.Check("1.8.2"); err == nil {
+		t.Error("expected 1.8.2 to be rejected")
+	}
+	if err := (&VersionPolicy{}).Check("garbage"); err != nil {
+		t.Error("expected empty policy to allow any version")
+	}
+}
@@ -0,0 +1,121 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/yunfeiyang1916/cloud-chisel/share/settings"
+	"golang.org/x/crypto/ssh"
+)
+
+// 隧道断开时新连接的处理方式
+const (
+	// DownHold 等待重连，超时后关闭连接
+	DownHold = "hold"
+	// DownReject 立即关闭连接
+	DownReject = "reject"
+	// DownQueue 与 DownHold 相同，但同时等待的连接数量有上限，超过时立即关闭。udp映射不支持
+	DownQueue = "queue"
+)
+
+// 隧道断开时新连接的结果，记录在 ForwardInfo.Down 中
+const (
+	// DownHeld 等待重连后正常转发
+	DownHeld = "held"
+	// DownRejected 按策略立即关闭
+	DownRejected = "rejected"
+	// DownTimeout 等待重连超时
+	DownTimeout = "timeout"
+	// DownQueueFull 等待队列已满
+	DownQueueFull = "queue_full"
+)
+
+// DownPolicy 隧道断开时远程映射新连接的处理策略
+type DownPolicy struct {
+	// 处理方式，DownHold(默认)、DownReject 或 DownQueue
+	Mode string
+	// 等待重连的最长时间，默认为 SSH_WAIT(35秒)
+	Timeout time.Duration
+	// DownQueue 时同时等待的连接数量上限
+	QueueSize int
+}
+
+// Validate 检查策略的配置
+func (p DownPolicy) Validate() error {
+	switch p.Mode {
+	case "", DownHold, DownReject:
+	case DownQueue:
+		if p.QueueSize <= 0 {
+			return errors.New("queue down policy requires a positive queue size")
+		}
+	default:
+		return fmt.Errorf("invalid down policy '%s'", p.Mode)
+	}
+	return nil
+}
+
+// 各个远程映射正在等待重连的连接数量
+type downQueues struct {
+	sync.Mutex
+	waiting map[string]int
+}
+
+// 占用等待队列的位置，队列已满时返回false
+func (q *downQueues) enter(key string, size int) bool {
+	q.Lock()
+	defer q.Unlock()
+	if q.waiting == nil {
+		q.waiting = map[string]int{}
+	}
+	if q.waiting[key] >= size {
+		return false
+	}
+	q.waiting[key]++
+	return true
+}
+
+func (q *downQueues) leave(key string) {
+	q.Lock()
+	q.waiting[key]--
+	q.Unlock()
+}
+
+// 按远程映射的策略获取ssh连接，隧道已连接时直接返回，否则按策略等待或拒绝，
+// 并返回记录在 ForwardInfo.Down 中的结果。r 为nil表示不属于任何映射的连接(比如 DialContext)
+func (t *Tunnel) getSSHFor(ctx context.Context, r *settings.Remote) (ssh.Conn, string) {
+	if c := t.nextSSH(); c != nil {
+		return c, ""
+	}
+	policy := DownPolicy{}
+	if t.DownPolicy != nil {
+		policy = t.DownPolicy(r)
+	}
+	timeout := policy.Timeout
+	if timeout <= 0 {
+		timeout = settings.EnvDuration("SSH_WAIT", 35*time.Second)
+	}
+	switch policy.Mode {
+	case DownReject:
+		return nil, DownRejected
+	case DownQueue:
+		key := ""
+		if r != nil {
+			key = r.Encode()
+		}
+		if !t.downQueues.enter(key, policy.QueueSize) {
+			return nil, DownQueueFull
+		}
+		defer t.downQueues.leave(key)
+	}
+	if c := t.waitSSH(ctx, timeout); c != nil {
+		return c, DownHeld
+	}
+	if ctx.Err() != nil {
+		// 代理已关闭
+		return nil, ""
+	}
+	return nil, DownTimeout
+}
@@ -0,0 +1,84 @@
+package tunnel
+
+import (
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/yunfeiyang1916/cloud-chisel/share/settings"
+)
+
+// ForwardInfo 一个转发连接的信息
+type ForwardInfo struct {
+	// 连接编号
+	ID int32
+	// 连接所属的远程映射，对端请求的目标不属于任何映射时为nil
+	Remote *settings.Remote
+	// 来源地址
+	Source string
+	// 目标地址
+	Target string
+	// 协议，tcp、udp或socks
+	Proto string
+	// 从来源发往目标的字节数
+	Sent int64
+	// 从目标返回来源的字节数
+	Received int64
+	// 连接建立的时间
+	Start time.Time
+	// 连接持续时长
+	Duration time.Duration
+	// 导致连接关闭的错误，正常关闭时为nil
+	Err error
+	// 连接到达时隧道已断开的处理结果，比如 DownHeld、DownRejected，隧道正常时为空
+	Down string
+}
+
+// Reason 连接关闭的原因
+func (f *ForwardInfo) Reason() string {
+	if f.Err == nil || strings.HasSuffix(f.Err.Error(), "EOF") {
+		return "closed"
+	}
+	return f.Err.Error()
+}
+
+// 转发开始时触发回调
+func (t *Tunnel) forwardOpened(f *ForwardInfo) {
+	if t.OnForwardOpen != nil {
+		t.OnForwardOpen(f)
+	}
+}
+
+// 转发结束时填充时长并触发回调
+func (t *Tunnel) forwardClosed(f *ForwardInfo) {
+	f.Duration = time.Since(f.Start)
+	if t.OnForwardClose != nil {
+		t.OnForwardClose(f)
+	}
+}
+
+// countRWC 统计读写字节数的 io.ReadWriteCloser
+type countRWC struct {
+	io.ReadWriteCloser
+	read, written int64
+}
+
+func (c *countRWC) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *countRWC) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+// 查找目标地址对应的远程映射
+func (t *Tunnel) findRemote(target string) *settings.Remote {
+	t.remotesMut.RLock()
+	defer t.remotesMut.RUnlock()
+	return settings.Remotes(t.Remotes).Find(target)
+}
@@ -0,0 +1,49 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter 令牌桶限速器，限制每秒新建连接的数量
+type rateLimiter struct {
+	mut sync.Mutex
+	// 每秒产生的令牌数
+	rate float64
+	// 桶的容量，至少为1
+	burst float64
+	// 当前可用令牌数
+	tokens float64
+	// 上一次补充令牌的时间
+	last time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// allow 尝试取出一个令牌，桶为空时返回false
+func (r *rateLimiter) allow() bool {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+	r.last = now
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
@@ -0,0 +1,68 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+)
+
+// RTTStats 保活ping的往返时间统计，平滑方式与TCP的RTO估算(RFC 6298)相同
+type RTTStats struct {
+	// 最近一次的往返时间
+	Last time.Duration
+	// 平滑的往返时间
+	Smoothed time.Duration
+	// 往返时间的平均偏差
+	Jitter time.Duration
+	// 成功的ping数量
+	Samples int64
+	// 超时未收到pong的ping数量
+	Missed int64
+}
+
+// rttTracker 记录ping的往返时间
+type rttTracker struct {
+	sync.Mutex
+	stats RTTStats
+}
+
+func (r *rttTracker) add(rtt time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+	s := &r.stats
+	if s.Samples == 0 {
+		s.Smoothed = rtt
+		s.Jitter = rtt / 2
+	} else {
+		diff := s.Smoothed - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		s.Jitter = (3*s.Jitter + diff) / 4
+		s.Smoothed = (7*s.Smoothed + rtt) / 8
+	}
+	s.Last = rtt
+	s.Samples++
+}
+
+func (r *rttTracker) miss() {
+	r.Lock()
+	r.stats.Missed++
+	r.Unlock()
+}
+
+func (r *rttTracker) get() RTTStats {
+	r.Lock()
+	defer r.Unlock()
+	return r.stats
+}
+
+// RTT 返回最早建立的活动连接的保活ping往返时间统计，每个连接单独统计，
+// 没有活动连接时返回最后断开的连接的统计，未启用 KeepAlive 时没有样本
+func (t *Tunnel) RTT() RTTStats {
+	t.activeConnMut.RLock()
+	defer t.activeConnMut.RUnlock()
+	if len(t.activeConns) == 0 {
+		return t.lastRTT
+	}
+	return t.rtts[t.activeConns[0]].get()
+}
@@ -5,10 +5,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/armon/go-socks5"
@@ -29,10 +32,32 @@ type Config struct {
 	Socks     bool
 	KeepAlive time.Duration
 	Remotes   []*settings.Remote
-	// 使用隧道转发请求时创建连接的回调
-	OnConnect func(localPort string, logger *cio.Logger)
-	// 使用隧道转发请求时结束连接的回调
-	OnClose func(localPort string, logger *cio.Logger)
+	// 等待pong的超时时间，默认与 KeepAlive 相同
+	KeepAliveTimeout time.Duration
+	// 连续错过多少次ping后认为对端已断开并关闭连接，默认为1
+	KeepAliveMaxMissed int
+	// 并发通道数量上限，0表示不限制
+	MaxChannels int
+	// 每秒新建连接数量上限，0表示不限制
+	ConnRate float64
+	// 检查是否允许对端请求的出站目标，返回错误时拒绝通道。nil表示允许全部目标
+	CheckTarget func(target string) error
+	// 开始监听远程映射的本地端口时的回调
+	OnBind func(r *settings.Remote)
+	// 停止监听远程映射的本地端口时的回调
+	OnUnbind func(r *settings.Remote)
+	// 转发连接打开时的回调
+	OnForwardOpen func(f *ForwardInfo)
+	// 转发连接关闭时的回调，携带连接的统计信息
+	OnForwardClose func(f *ForwardInfo)
+	// 处理对端发送的ping以外的SSH请求，返回false表示不认识该请求
+	HandleRequest func(r *ssh.Request) bool
+	// 返回远程映射在隧道断开时的新连接处理策略，r 为nil时用于 DialContext，nil表示全部等待重连
+	DownPolicy func(r *settings.Remote) DownPolicy
+	// 连接对端请求的服务(svc:<name>)，nil表示不支持服务转发
+	RelayService func(name string) (net.Conn, error)
+	// 解析对端请求的别名(@<name>)，返回实际的目标地址，nil表示不支持别名
+	ResolveAlias func(name string) (string, error)
 }
 
 // Tunnel 表示具有代理能力的SSH隧道, chisel的客户端和服务端都是隧道。
@@ -45,22 +70,46 @@ type Tunnel struct {
 	activeConnMut sync.RWMutex
 	// 同步组
 	activatingConn waitGroup
-	// 活跃的ssh连接
-	activeConn ssh.Conn
+	// 活跃的ssh连接，客户端使用连接池时有多个
+	activeConns []ssh.Conn
+	// 轮询选择连接的计数
+	nextConn uint32
 	// proxies
 	proxyCount int
 	// 连接计数器
 	connStats cnet.ConnCount
+	// 当前并发通道数量
+	channels int32
+	// 新建连接限速器
+	limiter *rateLimiter
 	// Socks5代理
 	socksServer *socks5.Server
+	// 进程内监听器，键为目标地址
+	listenersMut sync.RWMutex
+	listeners    map[string]*listener
+	// 保护 Remotes
+	remotesMut sync.RWMutex
+	// 运行中的代理，键为 Remote.Encode()
+	proxiesMut sync.Mutex
+	proxies    map[string]*boundProxy
+	// 按 DownQueue 策略等待重连的连接
+	downQueues downQueues
+	// 每个连接的ping往返时间统计，由 activeConnMut 保护
+	rtts map[ssh.Conn]*rttTracker
+	// 最后一个连接断开时的统计，没有连接时由 RTT 返回
+	lastRTT RTTStats
 }
 
 func New(c Config) *Tunnel {
 	c.Logger = c.Logger.Fork("tun")
 	t := &Tunnel{
 		Config: c,
+		rtts:   map[ssh.Conn]*rttTracker{},
 	}
 	t.activatingConn.Add(1)
+	if c.ConnRate > 0 {
+		t.limiter = newRateLimiter(c.ConnRate)
+	}
 	// 安装socks服务器(不监听任何端口!)
 	extra := ""
 	if c.Socks {
@@ -86,14 +135,23 @@ func (t *Tunnel) BindSSH(ctx context.Context, c ssh.Conn, reqs <-chan *ssh.Reque
 		t.activatingConn.DoneAll()
 	}()
 	t.activeConnMut.Lock()
-	if t.activeConn != nil {
-		panic("double bind ssh")
+	for _, active := range t.activeConns {
+		if active == c {
+			panic("double bind ssh")
+		}
+	}
+	t.activeConns = append(t.activeConns, c)
+	// 每个连接单独统计往返时间，重连或者切换服务端后重新开始
+	rtt := &rttTracker{}
+	t.rtts[c] = rtt
+	if len(t.activeConns) == 1 {
+		t.activatingConn.Done()
 	}
-	t.activeConn = c
 	t.activeConnMut.Unlock()
-	t.activatingConn.Done()
+	// 对端连续错过ping时关闭
+	dead := make(chan struct{})
 	if t.Config.KeepAlive > 0 {
-		go t.keepAliveLoop(c)
+		go t.keepAliveLoop(c, rtt, dead)
 	}
 	// 处理ssh在正常数据流之外发送的请求，接收ping,响应pong。
 	go t.handleSSHRequests(reqs)
@@ -102,51 +160,74 @@ func (t *Tunnel) BindSSH(ctx context.Context, c ssh.Conn, reqs <-chan *ssh.Reque
 	t.Debugf("SSH connected")
 	// 阻塞直到连接关闭
 	err := c.Wait()
+	select {
+	case <-dead:
+		err = cnet.ErrDeadPeer
+	default:
+	}
 	t.Debugf("SSH disconnected")
 	// mark inactive and block
-	t.activatingConn.Add(1)
 	t.activeConnMut.Lock()
-	t.activeConn = nil
+	conns := make([]ssh.Conn, 0, len(t.activeConns))
+	for _, active := range t.activeConns {
+		if active != c {
+			conns = append(conns, active)
+		}
+	}
+	t.activeConns = conns
+	delete(t.rtts, c)
+	if len(conns) == 0 {
+		t.lastRTT = rtt.get()
+		t.activatingConn.Add(1)
+	}
 	t.activeConnMut.Unlock()
 	return err
 }
 
 // 获取ssh连接，阻塞直到连接上
 func (t *Tunnel) getSSH(ctx context.Context) ssh.Conn {
+	return t.waitSSH(ctx, settings.EnvDuration("SSH_WAIT", 35*time.Second))
+}
+
+// 获取ssh连接，最多等待 timeout
+func (t *Tunnel) waitSSH(ctx context.Context, timeout time.Duration) ssh.Conn {
 	// 是否已取消
 	if isDone(ctx) {
 		return nil
 	}
-	t.activeConnMut.RLock()
-	c := t.activeConn
-	t.activeConnMut.RUnlock()
 	// 已经有连接了，直接返回
-	if c != nil {
+	if c := t.nextSSH(); c != nil {
 		return c
 	}
 	select {
 	case <-ctx.Done():
 		return nil
-	case <-time.After(settings.EnvDuration("SSH_WAIT", 35*time.Second)):
-		return nil // 比SSH超时时间稍长
+	case <-time.After(timeout):
+		return nil // 默认比SSH超时时间稍长
 	case <-t.activatingConnWait():
-		t.activeConnMut.RLock()
-		c := t.activeConn
-		t.activeConnMut.RUnlock()
-		return c
+		return t.nextSSH()
 	}
 }
 
-func (t *Tunnel) onConnectFunc(localPort string, logger *cio.Logger) {
-	if t.OnConnect != nil {
-		t.OnConnect(localPort, logger)
+// 轮询选择一个活跃的ssh连接，把新通道分散到连接池的各个连接上，未连接时为nil
+func (t *Tunnel) nextSSH() ssh.Conn {
+	t.activeConnMut.RLock()
+	defer t.activeConnMut.RUnlock()
+	if len(t.activeConns) == 0 {
+		return nil
 	}
+	n := atomic.AddUint32(&t.nextConn, 1)
+	return t.activeConns[int(n)%len(t.activeConns)]
 }
 
-func (t *Tunnel) onCloseFunc(localPort string, logger *cio.Logger) {
-	if t.OnClose != nil {
-		t.OnClose(localPort, logger)
+// 对端地址，未连接时为空
+func (t *Tunnel) peerAddr() string {
+	t.activeConnMut.RLock()
+	defer t.activeConnMut.RUnlock()
+	if len(t.activeConns) == 0 {
+		return ""
 	}
+	return t.activeConns[0].RemoteAddr().String()
 }
 
 func (t *Tunnel) activatingConnWait() <-chan struct{} {
@@ -168,19 +249,19 @@ func (t *Tunnel) BindRemotes(ctx context.Context, remotes []*settings.Remote) er
 	}
 	proxies := make([]*Proxy, len(remotes))
 	for i, remote := range remotes {
-		p, err := NewProxy(t.Logger, t, t.proxyCount, remote)
+		p, err := t.newProxy(remote)
 		if err != nil {
 			return err
 		}
 		proxies[i] = p
-		t.proxyCount++
 	}
 	// TODO: handle tunnel close
 	eg, ctx := errgroup.WithContext(ctx)
 	for _, proxy := range proxies {
-		p := proxy
+		// 每个代理可以通过 UnbindRemote 单独关闭
+		b := t.trackProxy(ctx, proxy)
 		eg.Go(func() error {
-			return p.Run(ctx)
+			return t.runProxy(b)
 		})
 	}
 	t.Debugf("Bound proxies")
@@ -189,43 +270,101 @@ func (t *Tunnel) BindRemotes(ctx context.Context, remotes []*settings.Remote) er
 	return err
 }
 
-// 持续保活
-func (t *Tunnel) keepAliveLoop(sshConn ssh.Conn) {
+// 持续保活，连续错过 KeepAliveMaxMissed 次ping后关闭 dead 和连接
+func (t *Tunnel) keepAliveLoop(sshConn ssh.Conn, rtt *rttTracker, dead chan struct{}) {
 	msg := fmt.Sprintf("[LocalAddr:%s]=>[RemoteAddr:%s]", sshConn.LocalAddr(), sshConn.RemoteAddr())
-	defer func() {
-		// 在ping异常时关闭连接
-		t.Errorf("%s,close ssh connection on abnormal ping", msg)
-		sshConn.Close()
-	}()
+	// 在ping异常时关闭连接
+	defer sshConn.Close()
+	timeout := t.Config.KeepAliveTimeout
+	if timeout <= 0 {
+		timeout = t.Config.KeepAlive
+	}
+	maxMissed := t.Config.KeepAliveMaxMissed
+	if maxMissed <= 0 {
+		maxMissed = 1
+	}
+	missed := 0
+	// 超时后仍未返回的ping，新的请求会排在它后面，往返时间不准确
+	var pending <-chan error
 	// 一直ping，持续保活
 	for {
 		time.Sleep(t.Config.KeepAlive)
-		// t.Infof("%s start send request keep alive", msg)
-		select {
-		case <-time.After(t.Config.KeepAlive):
-			return
-		case err := <-t.KeepAliveChan(sshConn):
-			if err != nil {
+		var err error
+		if pending != nil {
+			select {
+			case err = <-pending:
+				// 迟到的pong不计入往返时间
+				pending = nil
+			default:
+				err = errPingTimeout
+			}
+		}
+		var d time.Duration
+		if err == nil {
+			d, pending, err = t.ping(sshConn, timeout)
+		}
+		if err == errPingTimeout {
+			missed++
+			rtt.miss()
+			t.Debugf("%s missed ping (%d/%d)", msg, missed, maxMissed)
+			if missed >= maxMissed {
+				t.Errorf("%s missed %d pings, closing ssh connection", msg, missed)
+				close(dead)
 				return
 			}
+			continue
+		} else if err == io.EOF {
+			// 连接已关闭
+			return
+		} else if err != nil {
+			t.Errorf("%s ping error, closing ssh connection: %s", msg, err)
+			return
 		}
+		missed = 0
+		rtt.add(d)
 	}
 }
 
+var errPingTimeout = errors.New("ping timeout")
+
+// 发送一次ping并等待pong，返回往返时间。超时时返回 errPingTimeout 和仍在等待pong的通道
+func (t *Tunnel) ping(sshConn ssh.Conn, timeout time.Duration) (time.Duration, <-chan error, error) {
+	t0 := time.Now()
+	// 带缓冲，超时后迟到的pong不会阻塞协程
+	ch := make(chan error, 1)
+	go func() {
+		_, b, err := sshConn.SendRequest("ping", true, nil)
+		if err == nil && len(b) > 0 && !bytes.Equal(b, []byte("pong")) {
+			t.Debugf("strange ping response")
+			err = fmt.Errorf("strange ping response")
+		}
+		ch <- err
+	}()
+	select {
+	case err := <-ch:
+		if err != nil {
+			return 0, nil, err
+		}
+		return time.Since(t0), nil, nil
+	case <-time.After(timeout):
+		return 0, ch, errPingTimeout
+	}
+}
+
+// KeepAliveChan 发送一次ping，出错或者回复异常时通过返回的通道报告错误，完成后关闭通道
+//
+// Deprecated: 设置 Config.KeepAlive 后隧道会自动保活，并通过 RTT 提供往返时间统计
 func (t *Tunnel) KeepAliveChan(sshConn ssh.Conn) <-chan error {
 	msg := fmt.Sprintf("[LocalAddr:%s]=>[RemoteAddr:%s]", sshConn.LocalAddr(), sshConn.RemoteAddr())
 	ch := make(chan error)
 	go func() {
 		defer close(ch)
 		_, b, err := sshConn.SendRequest("ping", true, nil)
-		// t.Infof("%s end send request keep alive", msg)
 		if err != nil {
 			t.Errorf("%s ping error,err=%s", msg, err)
 			ch <- err
 		}
-		// t.Infof("%s keep alive content %s", msg, string(b))
 		if len(b) > 0 && !bytes.Equal(b, []byte("pong")) {
-			t.Debugf("strange ping response")
 			t.Errorf("%s strange ping response", msg)
 			ch <- fmt.Errorf("strange ping response")
 		}
@@ -0,0 +1,85 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/yunfeiyang1916/cloud-chisel/share/cnet"
+	"golang.org/x/crypto/ssh"
+)
+
+// DialContext 通过隧道打开一个到对端的连接，由对端连接 addr，
+// 对端会按照与端口映射相同的规则检查是否允许访问 addr。目前只支持tcp。
+// 隧道断开时按 Config.DownPolicy(nil) 的策略等待或拒绝
+func (t *Tunnel) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported network: %s", network)
+	}
+	sshConn, down := t.getSSHFor(ctx, nil)
+	if sshConn == nil {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("no ssh connection (%s)", down)
+	}
+	// 对端在连接完成后才接受通道，因此以协程打开通道以便响应ctx的取消
+	type result struct {
+		ch  ssh.Channel
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		ch, reqs, err := sshConn.OpenChannel("chisel", []byte(addr))
+		if err == nil {
+			go ssh.DiscardRequests(reqs)
+		}
+		done <- result{ch, err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, r.err
+		}
+		return &channelConn{
+			Conn:   cnet.NewRWCConn(r.ch),
+			local:  sshConn.LocalAddr(),
+			remote: tunnelAddr(addr),
+		}, nil
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.err == nil {
+				r.ch.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// channelConn 以 net.Conn 表示的SSH通道
+type channelConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *channelConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *channelConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// tunnelAddr 由隧道对端连接的地址
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string {
+	return "tcp"
+}
+
+func (a tunnelAddr) String() string {
+	return string(a)
+}
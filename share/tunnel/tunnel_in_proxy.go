@@ -2,8 +2,11 @@ package tunnel
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net"
+	"sync/atomic"
+	"time"
 
 	"github.com/jpillora/sizestr"
 	"github.com/yunfeiyang1916/cloud-chisel/share/cio"
@@ -13,9 +16,9 @@ import (
 
 // ssh 隧道接口，Tunnel子类型
 type sshTunnel interface {
-	getSSH(ctx context.Context) ssh.Conn
-	onConnectFunc(localPort string, logger *cio.Logger)
-	onCloseFunc(localPort string, logger *cio.Logger)
+	getSSHFor(ctx context.Context, r *settings.Remote) (ssh.Conn, string)
+	forwardOpened(f *ForwardInfo)
+	forwardClosed(f *ForwardInfo)
 }
 
 type Proxy struct {
@@ -23,7 +26,7 @@ type Proxy struct {
 	// ssh 隧道
 	sshTun sshTunnel
 	id     int
-	count  int
+	count  int32
 	remote *settings.Remote
 	dialer net.Dialer
 	// tcp 侦听器
@@ -125,20 +128,34 @@ func (p *Proxy) runTCP(ctx context.Context) error {
 // 远程管道
 func (p *Proxy) pipeRemote(ctx context.Context, src io.ReadWriteCloser) {
 	defer src.Close()
-	p.count++
-	cid := p.count
+	cid := atomic.AddInt32(&p.count, 1)
 	l := p.Fork("conn#%d", cid)
 	l.Debugf("Open")
-	p.sshTun.onConnectFunc(p.remote.LocalPort, l)
-	sshConn := p.sshTun.getSSH(ctx)
+	f := &ForwardInfo{
+		ID:     cid,
+		Remote: p.remote,
+		Source: "stdio",
+		Target: p.remote.Remote(),
+		Proto:  p.remote.RemoteProto,
+		Start:  time.Now(),
+	}
+	if c, ok := src.(net.Conn); ok {
+		f.Source = c.RemoteAddr().String()
+	}
+	p.sshTun.forwardOpened(f)
+	defer p.sshTun.forwardClosed(f)
+	sshConn, down := p.sshTun.getSSHFor(ctx, p.remote)
+	f.Down = down
 	if sshConn == nil {
-		l.Debugf("No remote connection")
+		l.Debugf("No remote connection (%s)", down)
+		f.Err = errors.New("no remote connection")
 		return
 	}
 	// 此代理的远程TCP连接的SSH请求
 	dst, reqs, err := sshConn.OpenChannel("chisel", []byte(p.remote.Remote()))
 	if err != nil {
-		l.Infof("Stream error: %s", err)
+		logOpenError(l, err)
+		f.Err = err
 		return
 	}
 	// 读取来自传入通道的所有请求，并响应false
@@ -146,5 +163,14 @@ func (p *Proxy) pipeRemote(ctx context.Context, src io.ReadWriteCloser) {
 	//then pipe
 	s, r := cio.Pipe(src, dst)
 	l.Debugf("Close (sent %s received %s)", sizestr.ToString(s), sizestr.ToString(r))
-	p.sshTun.onCloseFunc(p.remote.LocalPort, l)
+	f.Sent, f.Received = s, r
+}
+
+// 打开通道失败时打印日志，对端资源不足时给出明确的拒绝原因
+func logOpenError(l *cio.Logger, err error) {
+	if e, ok := err.(*ssh.OpenChannelError); ok && e.Reason == ssh.ResourceShortage {
+		l.Infof("Rejected by peer, resource shortage: %s", e.Message)
+		return
+	}
+	l.Infof("Stream error: %s", err)
 }
@@ -3,6 +3,7 @@ package tunnel
 import (
 	"context"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"github.com/jpillora/sizestr"
 	"github.com/yunfeiyang1916/cloud-chisel/share/cio"
@@ -40,14 +41,18 @@ func listenUDP(l *cio.Logger, sshTun sshTunnel, remote *settings.Remote) (*udpLi
 	}
 	//ready
 	u := &udpListener{
-		Logger:  l,
-		sshTun:  sshTun,
-		remote:  remote,
-		inbound: conn,
+		Logger:   l,
+		sshTun:   sshTun,
+		remote:   remote,
+		inbound:  conn,
+		acquired: make(chan struct{}, 1),
 	}
 	return u, nil
 }
 
+// 隧道断开且按策略没有等到连接
+var errUDPDown = errors.New("no remote connection")
+
 type udpListener struct {
 	*cio.Logger
 	sshTun sshTunnel
@@ -57,6 +62,9 @@ type udpListener struct {
 	outboundMut sync.Mutex
 	// 出站
 	outbound *udpChannel
+	// 新建出站通道时的通知，出站通道只由入站的数据包建立
+	acquired chan struct{}
+	count    int
 	sent     int64
 	recv     int64
 }
@@ -93,11 +101,16 @@ func (u *udpListener) runInbound(ctx context.Context) error {
 			return u.Errorf("read error: %w", err)
 		}
 		//upsert ssh channel
-		uc, err := u.getUDPChan(ctx)
+		uc, err := u.getUDPChan(ctx, addr)
 		if err != nil {
 			if strings.HasSuffix(err.Error(), "EOF") {
 				continue
 			}
+			// 隧道断开时按策略丢弃数据包
+			if errors.Is(err, errUDPDown) {
+				u.Debugf("Dropped packet: %s", err)
+				continue
+			}
 			return u.Errorf("inbound-udpchan: %w", err)
 		}
 		//send over channel, including source address
@@ -116,13 +129,14 @@ func (u *udpListener) runInbound(ctx context.Context) error {
 
 func (u *udpListener) runOutbound(ctx context.Context) error {
 	for !isDone(ctx) {
-		//upsert ssh channel
-		uc, err := u.getUDPChan(ctx)
-		if err != nil {
-			if strings.HasSuffix(err.Error(), "EOF") {
-				continue
+		// 等待入站的数据包建立通道，隧道断开时的策略只作用于入站的数据包
+		uc := u.currentUDPChan()
+		if uc == nil {
+			select {
+			case <-ctx.Done():
+			case <-u.acquired:
 			}
-			return u.Errorf("outbound-udpchan: %w", err)
+			continue
 		}
 		//receive from channel, including source address
 		p := udpPacket{}
@@ -147,7 +161,16 @@ func (u *udpListener) runOutbound(ctx context.Context) error {
 	return nil
 }
 
-func (u *udpListener) getUDPChan(ctx context.Context) (*udpChannel, error) {
+// 当前的出站通道，没有时为nil
+func (u *udpListener) currentUDPChan() *udpChannel {
+	u.outboundMut.Lock()
+	defer u.outboundMut.Unlock()
+	return u.outbound
+}
+
+// 返回出站通道，没有时为来自src的数据包建立新通道。
+// 每个通道作为一次转发记录，隧道断开时的处理结果记录在 ForwardInfo.Down
+func (u *udpListener) getUDPChan(ctx context.Context, src *net.UDPAddr) (*udpChannel, error) {
 	u.outboundMut.Lock()
 	defer u.outboundMut.Unlock()
 	//cached
@@ -155,20 +178,38 @@ func (u *udpListener) getUDPChan(ctx context.Context) (*udpChannel, error) {
 		return u.outbound, nil
 	}
 	//not cached, bind
-	sshConn := u.sshTun.getSSH(ctx)
+	u.count++
+	f := &ForwardInfo{
+		ID:     int32(u.count),
+		Remote: u.remote,
+		Source: src.String(),
+		Target: u.remote.Remote(),
+		Proto:  "udp",
+		Start:  time.Now(),
+	}
+	u.sshTun.forwardOpened(f)
+	sshConn, down := u.sshTun.getSSHFor(ctx, u.remote)
+	f.Down = down
 	if sshConn == nil {
-		return nil, fmt.Errorf("ssh-conn nil")
+		f.Err = ctx.Err()
+		if f.Err == nil {
+			f.Err = fmt.Errorf("%w (%s)", errUDPDown, down)
+		}
+		u.sshTun.forwardClosed(f)
+		return nil, f.Err
 	}
 	//ssh request for udp packets for this proxy's remote,
 	//just "udp" since the remote address is sent with each packet
 	dstAddr := u.remote.Remote() + "/udp"
 	rwc, reqs, err := sshConn.OpenChannel("chisel", []byte(dstAddr))
 	if err != nil {
+		f.Err = err
+		u.sshTun.forwardClosed(f)
 		return nil, fmt.Errorf("ssh-chan error: %s", err)
 	}
 	go ssh.DiscardRequests(reqs)
 	//remove on disconnect
-	go u.unsetUDPChan(sshConn)
+	go u.unsetUDPChan(sshConn, f, atomic.LoadInt64(&u.sent), atomic.LoadInt64(&u.recv))
 	//ready
 	o := &udpChannel{
 		r: gob.NewDecoder(rwc),
@@ -177,13 +218,21 @@ func (u *udpListener) getUDPChan(ctx context.Context) (*udpChannel, error) {
 	}
 	u.outbound = o
 	u.Debugf("aquired channel")
+	select {
+	case u.acquired <- struct{}{}:
+	default:
+	}
 	return o, nil
 }
 
-func (u *udpListener) unsetUDPChan(sshConn ssh.Conn) {
+// 连接断开时移除出站通道，并以通道存续期间的字节数结束转发记录
+func (u *udpListener) unsetUDPChan(sshConn ssh.Conn, f *ForwardInfo, sent, recv int64) {
 	sshConn.Wait()
 	u.Debugf("lost channel")
 	u.outboundMut.Lock()
 	u.outbound = nil
 	u.outboundMut.Unlock()
+	f.Sent = atomic.LoadInt64(&u.sent) - sent
+	f.Received = atomic.LoadInt64(&u.recv) - recv
+	u.sshTun.forwardClosed(f)
 }
@@ -0,0 +1,119 @@
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/yunfeiyang1916/cloud-chisel/share/cnet"
+)
+
+// Listen 返回一个 net.Listener，对端请求连接 target 的通道不再由本端拨号，
+// 而是作为连接交给监听器的 Accept
+func (t *Tunnel) Listen(target string) (net.Listener, error) {
+	t.listenersMut.Lock()
+	defer t.listenersMut.Unlock()
+	if t.listeners == nil {
+		t.listeners = map[string]*listener{}
+	}
+	if _, ok := t.listeners[target]; ok {
+		return nil, errors.New("already listening on " + target)
+	}
+	l := &listener{
+		t:      t,
+		target: target,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	t.listeners[target] = l
+	return l, nil
+}
+
+// 获取目标地址对应的监听器
+func (t *Tunnel) getListener(target string) *listener {
+	t.listenersMut.RLock()
+	defer t.listenersMut.RUnlock()
+	return t.listeners[target]
+}
+
+// CloseListener 关闭 Listen 在目标地址上创建的监听器，阻塞的 Accept 返回 net.ErrClosed。
+// 没有该监听器时返回false
+func (t *Tunnel) CloseListener(target string) bool {
+	l := t.getListener(target)
+	if l == nil {
+		return false
+	}
+	l.Close()
+	return true
+}
+
+// 将通道交给监听器，阻塞直到连接被关闭
+func (t *Tunnel) handleListener(l *listener, src io.ReadWriteCloser) error {
+	c := &listenerConn{
+		Conn: cnet.NewRWCConn(src),
+		addr: tunnelAddr(l.target),
+		done: make(chan struct{}),
+	}
+	select {
+	case l.conns <- c:
+	case <-l.closed:
+		return net.ErrClosed
+	}
+	<-c.done
+	return nil
+}
+
+// listener 接收对端通过隧道转发过来的连接
+type listener struct {
+	t      *Tunnel
+	target string
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		l.t.listenersMut.Lock()
+		delete(l.t.listeners, l.target)
+		l.t.listenersMut.Unlock()
+	})
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return tunnelAddr(l.target)
+}
+
+// listenerConn 监听器接收的连接，关闭时通知通道处理结束
+type listenerConn struct {
+	net.Conn
+	addr net.Addr
+	once sync.Once
+	done chan struct{}
+}
+
+func (c *listenerConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { close(c.done) })
+	return err
+}
+
+func (c *listenerConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *listenerConn) RemoteAddr() net.Addr {
+	return c.addr
+}
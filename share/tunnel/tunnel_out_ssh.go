@@ -5,6 +5,8 @@ import (
 	"io"
 	"net"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/jpillora/sizestr"
 	"github.com/yunfeiyang1916/cloud-chisel/share/cio"
@@ -20,7 +22,11 @@ func (t *Tunnel) handleSSHRequests(reqs <-chan *ssh.Request) {
 		case "ping":
 			r.Reply(true, []byte("pong"))
 		default:
+			if t.HandleRequest != nil && t.HandleRequest(r) {
+				continue
+			}
 			t.Debugf("Unknown request: %s", r.Type)
+			r.Reply(false, nil)
 		}
 	}
 }
@@ -46,31 +52,101 @@ func (t *Tunnel) handleSSHChannel(ch ssh.NewChannel) {
 	hostPort, proto := settings.L4Proto(remote)
 	udp := proto == "udp"
 	socks := hostPort == "socks"
+	service, relay := settings.ServiceName(hostPort)
+	alias, aliased := settings.AliasName(hostPort)
+	if t.CheckTarget != nil {
+		if err := t.CheckTarget(remote); err != nil {
+			t.Debugf("Denied outbound connection to %s: %s", remote, err)
+			ch.Reject(ssh.Prohibited, err.Error())
+			return
+		}
+	}
+	// 别名由本端解析成实际的目标，访问控制仍然按别名检查
+	if aliased {
+		if t.ResolveAlias == nil {
+			t.Debugf("Denied alias request %s", remote)
+			ch.Reject(ssh.Prohibited, "aliases are not supported")
+			return
+		}
+		addr, err := t.ResolveAlias(alias)
+		if err != nil {
+			t.Debugf("Failed to resolve %s: %s", remote, err)
+			ch.Reject(ssh.ConnectionFailed, err.Error())
+			return
+		}
+		hostPort = addr
+	}
+	if relay && (udp || t.RelayService == nil) {
+		t.Debugf("Denied service request %s", remote)
+		ch.Reject(ssh.Prohibited, "service relay is not supported")
+		return
+	}
 	if socks && t.socksServer == nil {
 		t.Debugf("Denied socks request, please enable socks")
 		ch.Reject(ssh.Prohibited, "SOCKS5 is not enabled")
 		return
 	}
+	// 检查连接限制
+	if t.limiter != nil && !t.limiter.allow() {
+		t.Debugf("Denied connection, rate limit exceeded")
+		ch.Reject(ssh.ResourceShortage, fmt.Sprintf("connection rate limit exceeded (max %g/s)", t.ConnRate))
+		return
+	}
+	n := atomic.AddInt32(&t.channels, 1)
+	defer atomic.AddInt32(&t.channels, -1)
+	if t.MaxChannels > 0 && int(n) > t.MaxChannels {
+		t.Debugf("Denied connection, too many channels")
+		ch.Reject(ssh.ResourceShortage, fmt.Sprintf("too many channels (max %d)", t.MaxChannels))
+		return
+	}
+	// 先连接服务的发布方，失败时拒绝通道以便对端得到原因
+	var relayConn net.Conn
+	if relay {
+		c, err := t.RelayService(service)
+		if err != nil {
+			t.Debugf("Failed to relay %s: %s", remote, err)
+			ch.Reject(ssh.ConnectionFailed, err.Error())
+			return
+		}
+		relayConn = c
+	}
 	sshChan, reqs, err := ch.Accept()
 	if err != nil {
 		t.Debugf("Failed to accept stream: %s", err)
+		if relayConn != nil {
+			relayConn.Close()
+		}
 		return
 	}
-	stream := io.ReadWriteCloser(sshChan)
+	stream := &countRWC{ReadWriteCloser: sshChan}
 	// cnet.MeterRWC(t.Logger.Fork("sshchan"), sshChan)
 	defer stream.Close()
 	go ssh.DiscardRequests(reqs)
-	l := t.Logger.Fork("conn#%d", t.connStats.New())
+	id := t.connStats.New()
+	l := t.Logger.Fork("conn#%d", id)
 	// ready to handle
 	// 递增连接计数器打开数量
 	t.connStats.Open()
 	l.Debugf("Open %s", t.connStats.String())
-	forwardingPort := ""
-	if len(t.Remotes) > 0 {
-		forwardingPort = t.Remotes[0].LocalPort
+	f := &ForwardInfo{
+		ID:     id,
+		Remote: t.findRemote(remote),
+		Source: t.peerAddr(),
+		Target: hostPort,
+		Proto:  proto,
+		Start:  time.Now(),
 	}
-	t.onConnectFunc(forwardingPort, l)
 	if socks {
+		f.Target, f.Proto = "socks", "socks"
+	} else if !udp {
+		f.Proto = "tcp"
+	}
+	t.forwardOpened(f)
+	if relay {
+		err = t.handleRelay(l, stream, relayConn, service)
+	} else if ln := t.getListener(remote); ln != nil {
+		err = t.handleListener(ln, stream)
+	} else if socks {
 		err = t.handleSocks(stream)
 	} else if udp {
 		err = t.handleUDP(l, stream, hostPort)
@@ -83,12 +159,23 @@ func (t *Tunnel) handleSSHChannel(ch ssh.NewChannel) {
 		errmsg = fmt.Sprintf(" (error %s)", err)
 	}
 	l.Debugf("Close %s%s", t.connStats.String(), errmsg)
-	t.onCloseFunc(forwardingPort, l)
+	f.Sent = atomic.LoadInt64(&stream.read)
+	f.Received = atomic.LoadInt64(&stream.written)
+	f.Err = err
+	t.forwardClosed(f)
 }
 
 func (t *Tunnel) handleSocks(src io.ReadWriteCloser) error {
 	return t.socksServer.ServeConn(cnet.NewRWCConn(src))
 }
+
+// 转发到发布服务的对端
+func (t *Tunnel) handleRelay(l *cio.Logger, src io.ReadWriteCloser, dst net.Conn, service string) error {
+	s, r := cio.Pipe(src, dst)
+	l.Debugf("relayed %s sent %s received %s", service, sizestr.ToString(s), sizestr.ToString(r))
+	return nil
+}
+
 func (t *Tunnel) handleTCP(l *cio.Logger, src io.ReadWriteCloser, hostPort string) error {
 	dst, err := net.Dial("tcp", hostPort)
 	if err != nil {
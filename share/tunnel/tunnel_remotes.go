@@ -0,0 +1,100 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+
+	"github.com/yunfeiyang1916/cloud-chisel/share/settings"
+)
+
+// SetRemotes 替换隧道的远程映射集合，用于运行中增删远程映射后更新转发信息
+func (t *Tunnel) SetRemotes(remotes []*settings.Remote) {
+	t.remotesMut.Lock()
+	t.Remotes = remotes
+	t.remotesMut.Unlock()
+}
+
+// BindRemote 在运行中的隧道上开始监听远程映射，不阻塞，
+// 直到 ctx 被取消或者调用 UnbindRemote 时关闭
+func (t *Tunnel) BindRemote(ctx context.Context, remote *settings.Remote) error {
+	if !t.Inbound {
+		return errors.New("inbound connections blocked")
+	}
+	if remote.Stdio {
+		return errors.New("stdio remote cannot be bound at runtime")
+	}
+	t.proxiesMut.Lock()
+	_, ok := t.proxies[remote.Encode()]
+	t.proxiesMut.Unlock()
+	if ok {
+		return errors.New("remote already bound: " + remote.String())
+	}
+	p, err := t.newProxy(remote)
+	if err != nil {
+		return err
+	}
+	go t.runProxy(t.trackProxy(ctx, p))
+	return nil
+}
+
+// UnbindRemote 关闭远程映射的代理，代理不存在时返回false
+func (t *Tunnel) UnbindRemote(remote *settings.Remote) bool {
+	t.proxiesMut.Lock()
+	b, ok := t.proxies[remote.Encode()]
+	delete(t.proxies, remote.Encode())
+	t.proxiesMut.Unlock()
+	if ok {
+		b.cancel()
+	}
+	return ok
+}
+
+// 运行中的代理
+type boundProxy struct {
+	*Proxy
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// 创建代理并开始监听
+func (t *Tunnel) newProxy(remote *settings.Remote) (*Proxy, error) {
+	t.proxiesMut.Lock()
+	index := t.proxyCount
+	t.proxyCount++
+	t.proxiesMut.Unlock()
+	return NewProxy(t.Logger, t, index, remote)
+}
+
+// 记录代理，代理的ctx在 UnbindRemote 时被取消
+func (t *Tunnel) trackProxy(ctx context.Context, p *Proxy) *boundProxy {
+	b := &boundProxy{Proxy: p}
+	b.ctx, b.cancel = context.WithCancel(ctx)
+	t.proxiesMut.Lock()
+	if t.proxies == nil {
+		t.proxies = map[string]*boundProxy{}
+	}
+	t.proxies[p.remote.Encode()] = b
+	t.proxiesMut.Unlock()
+	return b
+}
+
+// 运行代理并阻塞，结束时移除记录
+func (t *Tunnel) runProxy(b *boundProxy) error {
+	if t.OnBind != nil {
+		t.OnBind(b.remote)
+	}
+	defer func() {
+		if t.OnUnbind != nil {
+			t.OnUnbind(b.remote)
+		}
+	}()
+	err := b.Run(b.ctx)
+	b.cancel()
+	key := b.remote.Encode()
+	t.proxiesMut.Lock()
+	if t.proxies[key] == b {
+		delete(t.proxies, key)
+	}
+	t.proxiesMut.Unlock()
+	return err
+}